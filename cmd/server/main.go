@@ -13,6 +13,7 @@ import (
 	"github.com/mukund/mediaconvert/internal/config"
 	"github.com/mukund/mediaconvert/internal/db"
 	"github.com/mukund/mediaconvert/internal/handlers"
+	_ "github.com/mukund/mediaconvert/internal/operations" // Registers the built-in operations
 	"github.com/mukund/mediaconvert/internal/s3compat"
 	"github.com/mukund/mediaconvert/internal/system"
 	"github.com/mukund/mediaconvert/internal/worker"
@@ -76,12 +77,12 @@ func main() {
 		log.Printf("Created bucket: %s", cfg.S3Bucket)
 	}
 
-	// Connect to Redis
-	redisClient, err := worker.NewRedisClient(cfg.RedisURL)
+	// Connect to the job queue (Redis or PostgreSQL)
+	backend, err := worker.OpenBackend(cfg, database)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Fatalf("Failed to connect to the job queue: %v", err)
 	}
-	defer redisClient.Close()
+	defer backend.Close()
 
 	// Connect to ClickHouse (optional - continue if it fails)
 	var analyticsClient *analytics.Client
@@ -100,11 +101,13 @@ func main() {
 
 	// Setup Handlers
 	authHandler := handlers.NewAuthHandler(database)
-	jobHandler := handlers.NewJobHandler(database)
+	jobHandler := handlers.NewJobHandler(database, backend.Queue, backend.Canceller, minioClient, cfg)
+	batchHandler := handlers.NewBatchHandler(database, backend.Queue, backend.Canceller, cfg)
 	pipelineHandler := handlers.NewPipelineHandler(database)
 	s3CredentialHandler := handlers.NewS3CredentialHandler(database)
-	s3Handler := s3compat.NewS3Handler(database, minioClient, cfg, redisClient)
+	s3Handler := s3compat.NewS3Handler(database, minioClient, cfg, backend.Queue)
 	analyticsHandler := handlers.NewAnalyticsHandler(analyticsClient)
+	workerHandler := handlers.NewWorkerHandler(backend.Workers)
 
 	// Setup Router
 	r := gin.Default()
@@ -115,6 +118,7 @@ func main() {
 			"status": "ok",
 		})
 	})
+	r.GET("/schemas/pipeline.json", pipelineHandler.GetPipelineSchema)
 
 	// Auth routes
 	authGroup := r.Group("/auth")
@@ -137,10 +141,22 @@ func main() {
 		})
 
 		// Job routes
+		protected.POST("/jobs", jobHandler.CreateJob)
 		protected.GET("/jobs", jobHandler.ListJobs)
+		protected.GET("/jobs/dead-letter", jobHandler.ListDeadLetterJobs)
 		protected.GET("/jobs/:id", jobHandler.GetJob)
+		protected.GET("/jobs/:id/logs", jobHandler.ListJobLogs)
+		protected.GET("/jobs/:id/logs/:step", jobHandler.GetJobLog)
 		protected.POST("/jobs/:id/cancel", jobHandler.CancelJob)
 		protected.POST("/jobs/:id/rerun", jobHandler.RerunJob)
+		protected.POST("/jobs/:id/requeue", jobHandler.RequeueJob)
+
+		// Batch routes
+		protected.POST("/batches", batchHandler.CreateBatch)
+		protected.GET("/batches", batchHandler.ListBatches)
+		protected.GET("/batches/:id", batchHandler.GetBatch)
+		protected.POST("/batches/:id/cancel", batchHandler.CancelBatch)
+		protected.POST("/batches/:id/rerun-failed", batchHandler.RerunFailedBatch)
 
 		// Pipeline routes
 		protected.POST("/pipelines", pipelineHandler.CreatePipeline)
@@ -148,6 +164,10 @@ func main() {
 		protected.GET("/pipelines/:id", pipelineHandler.GetPipeline)
 		protected.PUT("/pipelines/:id", pipelineHandler.UpdatePipeline)
 		protected.DELETE("/pipelines/:id", pipelineHandler.DeletePipeline)
+		protected.GET("/pipelines/:id/versions", pipelineHandler.ListPipelineVersions)
+		protected.GET("/pipelines/:id/versions/:version", pipelineHandler.GetPipelineVersion)
+		protected.GET("/pipelines/:id/versions/:version/diff", pipelineHandler.DiffPipelineVersions)
+		protected.POST("/pipelines/:id/rollback", pipelineHandler.RollbackPipeline)
 
 		// S3 Credential routes
 		protected.POST("/s3-credentials", s3CredentialHandler.CreateCredentials)
@@ -159,6 +179,9 @@ func main() {
 		protected.GET("/analytics/jobs/stats", analyticsHandler.GetJobStats)
 		protected.GET("/analytics/jobs/timeline", analyticsHandler.GetJobTimeline)
 		protected.GET("/analytics/pipelines/stats", analyticsHandler.GetPipelineStats)
+
+		// Admin routes
+		protected.GET("/workers", auth.RequireAdmin(database), workerHandler.ListWorkers)
 	}
 
 	// S3-Compatible API routes (separate from /api)
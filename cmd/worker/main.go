@@ -6,14 +6,16 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/mukund/mediaconvert/internal/analytics"
 	"github.com/mukund/mediaconvert/internal/config"
 	"github.com/mukund/mediaconvert/internal/db"
+	_ "github.com/mukund/mediaconvert/internal/operations" // Registers the built-in operations
+	"github.com/mukund/mediaconvert/internal/system"
 	"github.com/mukund/mediaconvert/internal/worker"
 )
 
@@ -50,12 +52,12 @@ func main() {
 		log.Fatalf("Failed to initialize MinIO client: %v", err)
 	}
 
-	// Connect to Redis
-	redisClient, err := worker.NewRedisClient(cfg.RedisURL)
+	// Connect to the job queue (Redis or PostgreSQL)
+	backend, err := worker.OpenBackend(cfg, database)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Fatalf("Failed to connect to the job queue: %v", err)
 	}
-	defer redisClient.Close()
+	defer backend.Close()
 
 	// Connect to ClickHouse (optional - continue if it fails)
 	var analyticsClient *analytics.Client
@@ -73,49 +75,67 @@ func main() {
 	}
 
 	// Create job processor
-	processor := worker.NewJobProcessor(database, minioClient, cfg, redisClient, analyticsClient)
+	processor := worker.NewJobProcessor(database, minioClient, cfg, backend.Queue, backend.Canceller, analyticsClient)
 
-	// Setup graceful shutdown
+	// Setup graceful shutdown. ctx is cancelled on the first signal, after which no new
+	// jobs are taken; runCtx lives until the running jobs have drained.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	runCtx, stopRun := context.WithCancel(context.Background())
+	defer stopRun()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigChan
-		log.Println("Shutdown signal received, stopping worker...")
+		log.Printf("Shutdown signal received, draining worker (grace period %s)...", cfg.WorkerShutdownGrace)
 		cancel()
 	}()
 
-	// Subscribe to job notifications
-	pubsub := redisClient.SubscribeToJobNotifications(ctx)
-	defer pubsub.Close()
-
-	log.Println("Worker ready, listening for job notifications...")
-
-	// Listen for notifications
-	ch := pubsub.Channel()
-	for {
-		select {
-		case msg := <-ch:
-			// Parse job ID from message
-			jobID, err := strconv.ParseUint(msg.Payload, 10, 32)
-			if err != nil {
-				log.Printf("Invalid job ID in notification: %s", msg.Payload)
-				continue
-			}
-
-			log.Printf("Received job notification: %d", jobID)
+	// Re-queue pending jobs that were created while no worker was running,
+	// then keep returning jobs of crashed workers to the queue
+	reaper := worker.NewReaper(database, backend.Queue, backend.Canceller, analyticsClient, cfg)
+	if err := reaper.RecoverPending(ctx); err != nil {
+		log.Printf("Failed to recover pending jobs: %v", err)
+	}
+	go reaper.Run(ctx)
 
-			// Process job
-			if err := processor.ProcessJob(uint(jobID)); err != nil {
-				log.Printf("Failed to process job %d: %v", jobID, err)
-			}
+	// Enqueue scheduled jobs and retries once they are due
+	scheduler := worker.NewScheduler(database, backend.Queue, analyticsClient)
+	go scheduler.Run(ctx, time.Second)
 
-		case <-ctx.Done():
-			log.Println("Worker stopped")
-			return
-		}
+	// Only take jobs this host has the tools and encoders for
+	capabilities := cfg.WorkerCapabilities
+	if len(capabilities) == 0 {
+		capabilities = system.DetectCapabilities()
+	}
+	log.Printf("Worker capabilities: %v", capabilities)
+
+	// Register the worker and keep its heartbeat going until shutdown
+	registry := worker.NewRegistry(backend.Workers, processor, worker.WorkerInfo{
+		ID:           cfg.WorkerID,
+		Version:      system.Version,
+		Concurrency:  cfg.WorkerConcurrency,
+		Queues:       cfg.WorkerQueues,
+		Capabilities: capabilities,
+		Tools:        system.ToolVersions(),
+	}, cfg.WorkerHeartbeatInterval)
+	go registry.Run(runCtx)
+
+	// Stop running jobs when they are cancelled through the API, also while draining
+	go processor.ListenForCancellations(runCtx)
+
+	// Process jobs until shutdown, then drain the running ones
+	pool := worker.NewPool(backend.Queue, processor, cfg.WorkerID, cfg.WorkerQueues, capabilities, cfg.WorkerConcurrency, cfg.JobClaimIdle, cfg.WorkerShutdownGrace)
+
+	log.Printf("Worker %s ready with %d slots, waiting for jobs on queues %v...", cfg.WorkerID, cfg.WorkerConcurrency, cfg.WorkerQueues)
+	pool.Run(ctx)
+
+	stopRun()
+	if err := registry.Unregister(context.Background()); err != nil {
+		log.Printf("Failed to unregister worker: %v", err)
 	}
+
+	log.Println("Worker stopped")
 }
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -16,6 +19,53 @@ type Config struct {
 	S3Bucket      string `mapstructure:"S3_BUCKET"`
 	S3Region      string `mapstructure:"S3_REGION"`
 	JWTSecret     string `mapstructure:"JWT_SECRET"`
+
+	// Job queue backend: "redis" (Redis streams) or "postgres" (SKIP LOCKED and LISTEN/NOTIFY)
+	QueueBackend string `mapstructure:"QUEUE_BACKEND"`
+
+	// Worker settings
+	WorkerID     string        `mapstructure:"WORKER_ID"`      // Consumer name in the job stream and lease owner (defaults to hostname-pid)
+	JobClaimIdle time.Duration `mapstructure:"JOB_CLAIM_IDLE"` // Idle time after which an unacknowledged job is reclaimed
+
+	// Job leases and recovery
+	JobLeaseDuration time.Duration `mapstructure:"JOB_LEASE_DURATION"` // How long a job lease lasts without a heartbeat
+	ReaperInterval   time.Duration `mapstructure:"REAPER_INTERVAL"`    // How often expired leases are checked
+	PendingSweepAge  time.Duration `mapstructure:"PENDING_SWEEP_AGE"`  // Pending jobs older than this are re-queued on startup
+
+	WorkerConcurrency int      `mapstructure:"WORKER_CONCURRENCY"` // Number of jobs a worker processes in parallel
+	WorkerQueues      []string `mapstructure:"WORKER_QUEUES"`      // Queues a worker takes jobs from (comma-separated)
+
+	// Number of independent steps of a job that may run at once (pipelines may lower it)
+	MaxParallelSteps int `mapstructure:"MAX_PARALLEL_STEPS"`
+
+	// How long running jobs may take to finish on shutdown before they are stopped and re-queued
+	WorkerShutdownGrace time.Duration `mapstructure:"WORKER_SHUTDOWN_GRACE"`
+
+	// Capabilities a worker advertises (comma-separated); detected from the installed tools if empty
+	WorkerCapabilities []string `mapstructure:"WORKER_CAPABILITIES"`
+
+	// Worker registry
+	WorkerHeartbeatInterval time.Duration `mapstructure:"WORKER_HEARTBEAT_INTERVAL"` // How often a worker refreshes its registration
+
+	// How long an Idempotency-Key returns the job it created
+	IdempotencyKeyTTL time.Duration `mapstructure:"IDEMPOTENCY_KEY_TTL"`
+
+	// Default limits on each user's jobs (users may override them), 0 for no limit
+	UserMaxConcurrentJobs int `mapstructure:"USER_MAX_CONCURRENT_JOBS"` // Jobs a user may have running at once
+	UserMaxQueuedJobs     int `mapstructure:"USER_MAX_QUEUED_JOBS"`     // Jobs a user may have waiting to run
+
+	// Retry policy for transient failures (pipelines may override it)
+	RetryMaxAttempts int           `mapstructure:"RETRY_MAX_ATTEMPTS"`
+	RetryBackoff     time.Duration `mapstructure:"RETRY_BACKOFF"`
+	RetryMaxBackoff  time.Duration `mapstructure:"RETRY_MAX_BACKOFF"`
+	RetryJitter      float64       `mapstructure:"RETRY_JITTER"`
+
+	// Default resource limits for pipeline steps (steps may override them)
+	StepTimeout   time.Duration `mapstructure:"STEP_TIMEOUT"`
+	StepMaxMemory string        `mapstructure:"STEP_MAX_MEMORY"` // e.g. "4G", empty for no limit
+	StepNice      int           `mapstructure:"STEP_NICE"`
+	StepCPUWeight int           `mapstructure:"STEP_CPU_WEIGHT"`
+	CgroupRoot    string        `mapstructure:"CGROUP_ROOT"` // Delegated cgroup v2 directory for per-step cgroups
 }
 
 func LoadConfig() (*Config, error) {
@@ -32,6 +82,30 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("S3_BUCKET", "media")
 	viper.SetDefault("S3_REGION", "us-east-1")
 	viper.SetDefault("JWT_SECRET", "change-this-secret-in-production")
+	viper.SetDefault("QUEUE_BACKEND", "redis")
+	viper.SetDefault("WORKER_ID", "")
+	viper.SetDefault("JOB_CLAIM_IDLE", "5m")
+	viper.SetDefault("JOB_LEASE_DURATION", "2m")
+	viper.SetDefault("REAPER_INTERVAL", "30s")
+	viper.SetDefault("PENDING_SWEEP_AGE", "60s")
+	viper.SetDefault("WORKER_CONCURRENCY", 1)
+	viper.SetDefault("WORKER_QUEUES", "default")
+	viper.SetDefault("MAX_PARALLEL_STEPS", 2)
+	viper.SetDefault("WORKER_CAPABILITIES", "")
+	viper.SetDefault("WORKER_HEARTBEAT_INTERVAL", "10s")
+	viper.SetDefault("WORKER_SHUTDOWN_GRACE", "2m")
+	viper.SetDefault("IDEMPOTENCY_KEY_TTL", "24h")
+	viper.SetDefault("USER_MAX_CONCURRENT_JOBS", 0)
+	viper.SetDefault("USER_MAX_QUEUED_JOBS", 0)
+	viper.SetDefault("RETRY_MAX_ATTEMPTS", 3)
+	viper.SetDefault("RETRY_BACKOFF", "10s")
+	viper.SetDefault("RETRY_MAX_BACKOFF", "10m")
+	viper.SetDefault("RETRY_JITTER", 0.2)
+	viper.SetDefault("STEP_TIMEOUT", "1h")
+	viper.SetDefault("STEP_MAX_MEMORY", "")
+	viper.SetDefault("STEP_NICE", 0)
+	viper.SetDefault("STEP_CPU_WEIGHT", 0)
+	viper.SetDefault("CGROUP_ROOT", "")
 
 	if _, err := os.Stat(".env"); err == nil {
 		viper.SetConfigFile(".env")
@@ -45,5 +119,10 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	if config.WorkerID == "" {
+		hostname, _ := os.Hostname()
+		config.WorkerID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
 	return &config, nil
 }
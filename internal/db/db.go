@@ -27,9 +27,14 @@ func Migrate(db *gorm.DB) error {
 			&models.User{},
 			&models.File{},
 			&models.Pipeline{},
+			&models.PipelineVersion{},
+			&models.Batch{},
 			&models.Job{},
 			&models.JobStatusHistory{},
 			&models.S3Credential{},
+			&models.IdempotencyKey{},
+			&models.QueuedJob{},
+			&models.WorkerRegistration{},
 		); err != nil {
 		return err
 	}
@@ -39,5 +44,13 @@ func Migrate(db *gorm.DB) error {
 		log.Printf("Warning: Failed to create unique index on pipelines: %v", err)
 	}
 
+	// Pipelines created before versions were kept start with their current definition as version 1
+	if err := db.Exec(`INSERT INTO pipeline_versions (created_at, updated_at, pipeline_id, version, format, content, message)
+		SELECT NOW(), NOW(), p.id, p.version, p.format, p.content, ''
+		FROM pipelines p
+		WHERE NOT EXISTS (SELECT 1 FROM pipeline_versions v WHERE v.pipeline_id = p.id)`).Error; err != nil {
+		log.Printf("Warning: Failed to create initial pipeline versions: %v", err)
+	}
+
 	return nil
 }
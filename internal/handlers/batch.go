@@ -0,0 +1,640 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mukund/mediaconvert/internal/auth"
+	"github.com/mukund/mediaconvert/internal/config"
+	"github.com/mukund/mediaconvert/internal/models"
+	"github.com/mukund/mediaconvert/internal/worker"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxBatchFiles is the largest number of files a batch may run on
+const maxBatchFiles = 10000
+
+// Batch statuses, derived from the statuses of the batch's jobs
+const (
+	BatchStatusRunning   = "running"   // Some jobs haven't finished yet
+	BatchStatusCompleted = "completed" // All jobs completed
+	BatchStatusCanceled  = "canceled"  // All jobs finished, some were cancelled and none failed
+	BatchStatusFailed    = "failed"    // All jobs finished and some failed, expired or were dead-lettered
+)
+
+// unfinishedStatuses are the job statuses that keep a batch running
+var unfinishedStatuses = []models.JobStatus{
+	models.JobStatusPending,
+	models.JobStatusScheduled,
+	models.JobStatusProcessing,
+	models.JobStatusRetrying,
+}
+
+type BatchHandler struct {
+	db        *gorm.DB
+	queue     worker.Queue
+	canceller worker.Canceller
+	config    *config.Config
+}
+
+func NewBatchHandler(db *gorm.DB, queue worker.Queue, canceller worker.Canceller, cfg *config.Config) *BatchHandler {
+	return &BatchHandler{db: db, queue: queue, canceller: canceller, config: cfg}
+}
+
+type CreateBatchRequest struct {
+	PipelineID uint       `json:"pipeline_id" binding:"required"`
+	FileIDs    []uint     `json:"file_ids"` // Files to run the pipeline on...
+	Prefix     string     `json:"prefix"`   // ...or the S3 key prefix selecting them
+	Priority   int        `json:"priority"`
+	Queue      string     `json:"queue"`
+	RunAt      *time.Time `json:"run_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+
+	Params map[string]interface{} `json:"params"` // Values of the pipeline's parameters, for every job
+}
+
+type BatchSummary struct {
+	ID         uint                   `json:"id"`
+	PipelineID uint                   `json:"pipeline_id"`
+	Pipeline   *PipelineInfo          `json:"pipeline,omitempty"`
+	Prefix     string                 `json:"prefix,omitempty"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	Status     string                 `json:"status"`
+	Total      int64                  `json:"total"`
+	Counts     map[string]int64       `json:"counts"`  // Number of jobs per status
+	Percent    float64                `json:"percent"` // Share of jobs that finished
+	CreatedAt  string                 `json:"created_at"`
+}
+
+type BatchListResponse struct {
+	Batches    []BatchSummary     `json:"batches"`
+	Pagination PaginationResponse `json:"pagination"`
+}
+
+// CreateBatch creates a batch running a saved pipeline on a list of files, or on all the
+// user's files under an S3 key prefix, with a job per file
+func (h *BatchHandler) CreateBatch(c *gin.Context) {
+	userID, exists := auth.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req CreateBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if (len(req.FileIDs) == 0) == (req.Prefix == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Specify either file_ids or prefix"})
+		return
+	}
+	if len(req.FileIDs) > maxBatchFiles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A batch may run on at most %d files", maxBatchFiles)})
+		return
+	}
+	if req.Queue == "" {
+		req.Queue = models.DefaultJobQueue
+	}
+	if err := worker.ValidateJobRouting(req.Queue, req.Priority); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := worker.ValidateJobExpiry(req.ExpiresAt, req.RunAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var pipelineRecord models.Pipeline
+	if err := h.db.Where("id = ? AND user_id = ?", req.PipelineID, userID).First(&pipelineRecord).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline"})
+		}
+		return
+	}
+
+	version, err := worker.CurrentPipelineVersion(h.db, &pipelineRecord)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline version"})
+		return
+	}
+
+	params, paramsJSON, ok := resolveParams(c, version, req.Params)
+	if !ok {
+		return
+	}
+
+	files, ok := h.selectFiles(c, userID, req)
+	if !ok {
+		return
+	}
+
+	if !checkQueuedLimit(c, h.db, h.config, userID, len(files)) {
+		return
+	}
+
+	batch := models.Batch{
+		UserID:            userID,
+		PipelineID:        pipelineRecord.ID,
+		PipelineVersionID: &version.ID,
+		Prefix:            req.Prefix,
+		Params:            paramsJSON,
+	}
+	capabilities := worker.JobCapabilities(version, params)
+	expiresAt := worker.JobExpiry(version, req.RunAt, req.ExpiresAt)
+	jobs := make([]models.Job, len(files))
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&batch).Error; err != nil {
+			return err
+		}
+
+		for i, file := range files {
+			jobs[i] = models.Job{
+				FileID:            file.ID,
+				PipelineID:        &pipelineRecord.ID,
+				PipelineVersionID: &version.ID,
+				BatchID:           &batch.ID,
+				Params:            paramsJSON,
+				Status:            initialStatus(req.RunAt),
+				Priority:          req.Priority,
+				Queue:             req.Queue,
+				Capabilities:      capabilities,
+				RunAt:             req.RunAt,
+				ExpiresAt:         expiresAt,
+			}
+		}
+		if err := tx.CreateInBatches(&jobs, 500).Error; err != nil {
+			return err
+		}
+
+		history := make([]models.JobStatusHistory, len(jobs))
+		for i, job := range jobs {
+			history[i] = models.JobStatusHistory{
+				JobID:       job.ID,
+				ToStatus:    job.Status,
+				Message:     fmt.Sprintf("Job created via batch %d", batch.ID),
+				TriggeredBy: "user",
+			}
+		}
+		return tx.CreateInBatches(&history, 500).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create batch"})
+		return
+	}
+
+	// Enqueue jobs on the job queue; scheduled jobs are enqueued by the scheduler once due
+	if h.queue != nil {
+		for i := range jobs {
+			jobs[i].File = files[i]
+			if jobs[i].Status != models.JobStatusPending {
+				continue
+			}
+			if err := h.queue.Enqueue(&jobs[i]); err != nil {
+				log.Printf("Failed to enqueue job %d: %v", jobs[i].ID, err)
+			}
+		}
+	}
+
+	batch.Pipeline = pipelineRecord
+	batch.PipelineVersion = version
+	summaries, err := h.summarize([]models.Batch{batch})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarize batch"})
+		return
+	}
+	c.JSON(http.StatusCreated, summaries[0])
+}
+
+// selectFiles returns the user's files a batch runs on, responding with an error and
+// returning false if they can't be selected
+func (h *BatchHandler) selectFiles(c *gin.Context, userID uint, req CreateBatchRequest) ([]models.File, bool) {
+	var files []models.File
+
+	if req.Prefix != "" {
+		pattern := escapeLike(fmt.Sprintf("users/%d/%s", userID, strings.TrimPrefix(req.Prefix, "/"))) + "%"
+		if err := h.db.Where("user_id = ? AND s3_key LIKE ?", userID, pattern).
+			Order("id").
+			Limit(maxBatchFiles + 1).
+			Find(&files).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+			return nil, false
+		}
+		if len(files) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No files match the prefix"})
+			return nil, false
+		}
+		if len(files) > maxBatchFiles {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("More than %d files match the prefix", maxBatchFiles)})
+			return nil, false
+		}
+		return files, true
+	}
+
+	ids := slices.Clone(req.FileIDs)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	if err := h.db.Where("id IN ? AND user_id = ?", ids, userID).Order("id").Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return nil, false
+	}
+	if len(files) != len(ids) {
+		var missing []uint
+		for _, id := range ids {
+			if !slices.ContainsFunc(files, func(f models.File) bool { return f.ID == id }) {
+				missing = append(missing, id)
+			}
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Files not found: %v", missing)})
+		return nil, false
+	}
+	return files, true
+}
+
+// ListBatches returns a paginated list of the user's batches, most recent first
+func (h *BatchHandler) ListBatches(c *gin.Context) {
+	userID, exists := auth.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	query := h.db.Model(&models.Batch{}).Where("user_id = ?", userID)
+
+	var total int64
+	query.Count(&total)
+
+	var batches []models.Batch
+	if err := query.
+		Preload("Pipeline").
+		Preload("PipelineVersion").
+		Order("created_at DESC").
+		Limit(limit).
+		Offset((page - 1) * limit).
+		Find(&batches).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch batches"})
+		return
+	}
+
+	summaries, err := h.summarize(batches)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarize batches"})
+		return
+	}
+
+	c.JSON(http.StatusOK, BatchListResponse{
+		Batches: summaries,
+		Pagination: PaginationResponse{
+			Page:  page,
+			Limit: limit,
+			Total: total,
+		},
+	})
+}
+
+// GetBatch returns the summary of a batch: its status and how many of its jobs are in
+// each status. Use GET /api/jobs?batch_id= to list the jobs.
+func (h *BatchHandler) GetBatch(c *gin.Context) {
+	batch, ok := h.loadBatch(c)
+	if !ok {
+		return
+	}
+
+	summaries, err := h.summarize([]models.Batch{batch})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarize batch"})
+		return
+	}
+	c.JSON(http.StatusOK, summaries[0])
+}
+
+// CancelBatch cancels every job of a batch that hasn't finished yet
+func (h *BatchHandler) CancelBatch(c *gin.Context) {
+	batch, ok := h.loadBatch(c)
+	if !ok {
+		return
+	}
+
+	message := fmt.Sprintf("Job cancelled with batch %d", batch.ID)
+	now := time.Now()
+	cancelable := append(slices.Clone(unfinishedStatuses), models.JobStatusDeadLettered)
+
+	var history []models.JobStatusHistory
+	var running []uint
+	for _, status := range cancelable {
+		// Only cancel jobs still in the status they were found in, as in CancelJob
+		var canceled []models.Job
+		if err := h.db.Model(&canceled).
+			Scopes(latestBatchJobs).
+			Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+			Where("batch_id = ? AND status = ?", batch.ID, status).
+			Updates(map[string]interface{}{
+				"status":      models.JobStatusCanceled,
+				"error":       message,
+				"finished_at": now,
+			}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel batch"})
+			return
+		}
+
+		for _, job := range canceled {
+			history = append(history, models.JobStatusHistory{
+				JobID:       job.ID,
+				FromStatus:  status,
+				ToStatus:    models.JobStatusCanceled,
+				Message:     message,
+				TriggeredBy: "user",
+			})
+			if status == models.JobStatusProcessing {
+				running = append(running, job.ID)
+			}
+		}
+	}
+
+	if len(history) > 0 {
+		if err := h.db.CreateInBatches(&history, 500).Error; err != nil {
+			log.Printf("Failed to record status changes: %v", err)
+		}
+	}
+
+	// Tell the workers running the jobs to stop them
+	if h.canceller != nil {
+		for _, jobID := range running {
+			if err := h.canceller.PublishJobCancel(jobID); err != nil {
+				log.Printf("Failed to publish cancel signal for job %d: %v", jobID, err)
+			}
+		}
+	}
+
+	summaries, err := h.summarize([]models.Batch{batch})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarize batch"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Batch cancelled successfully",
+		"canceled": len(history),
+		"batch":    summaries[0],
+	})
+}
+
+// RerunFailedBatch runs the failed and dead-lettered jobs of a batch again, as new jobs of
+// the batch linked to the ones they rerun. The batch's counts leave out jobs that were
+// rerun, so that they keep covering each file once.
+func (h *BatchHandler) RerunFailedBatch(c *gin.Context) {
+	batch, ok := h.loadBatch(c)
+	if !ok {
+		return
+	}
+
+	var failed []models.Job
+	if err := h.db.Scopes(latestBatchJobs).
+		Preload("File").
+		Where("batch_id = ? AND status IN ?", batch.ID, []models.JobStatus{models.JobStatusFailed, models.JobStatusDeadLettered}).
+		Order("id").
+		Find(&failed).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch jobs"})
+		return
+	}
+	if len(failed) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Batch has no failed jobs"})
+		return
+	}
+	if !checkQueuedLimit(c, h.db, h.config, batch.UserID, len(failed)) {
+		return
+	}
+
+	// Run the version the batch was created with; batches created before versions were
+	// kept run the current version
+	version := batch.PipelineVersion
+	if version == nil {
+		if batch.Pipeline.ID == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "The batch's pipeline was deleted"})
+			return
+		}
+		var err error
+		if version, err = worker.CurrentPipelineVersion(h.db, &batch.Pipeline); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline version"})
+			return
+		}
+	}
+	var values map[string]interface{}
+	if len(batch.Params) > 0 {
+		if err := json.Unmarshal(batch.Params, &values); err != nil {
+			log.Printf("Failed to decode parameters of batch %d: %v", batch.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode batch parameters"})
+			return
+		}
+	}
+	params, paramsJSON, ok := resolveParams(c, version, values)
+	if !ok {
+		return
+	}
+	capabilities := worker.JobCapabilities(version, params)
+	expiresAt := worker.JobExpiry(version, nil, nil)
+
+	jobs := make([]models.Job, len(failed))
+	for i, job := range failed {
+		jobs[i] = models.Job{
+			FileID:            job.FileID,
+			RerunOfID:         &job.ID,
+			PipelineID:        &batch.PipelineID,
+			PipelineVersionID: &version.ID,
+			BatchID:           &batch.ID,
+			Params:            paramsJSON,
+			Status:            models.JobStatusPending,
+			Priority:          job.Priority,
+			Queue:             job.Queue,
+			Capabilities:      capabilities,
+			ExpiresAt:         expiresAt,
+		}
+	}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(&jobs, 500).Error; err != nil {
+			return err
+		}
+
+		history := make([]models.JobStatusHistory, len(jobs))
+		for i, job := range jobs {
+			history[i] = models.JobStatusHistory{
+				JobID:       job.ID,
+				ToStatus:    job.Status,
+				Message:     fmt.Sprintf("Job %d rerun with batch %d", failed[i].ID, batch.ID),
+				TriggeredBy: "user",
+			}
+		}
+		return tx.CreateInBatches(&history, 500).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rerun jobs"})
+		return
+	}
+
+	if h.queue != nil {
+		for i := range jobs {
+			jobs[i].File = failed[i].File
+			if err := h.queue.Enqueue(&jobs[i]); err != nil {
+				log.Printf("Failed to enqueue job %d: %v", jobs[i].ID, err)
+			}
+		}
+	}
+
+	summaries, err := h.summarize([]models.Batch{batch})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarize batch"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Failed jobs rerun successfully",
+		"rerun":   len(jobs),
+		"batch":   summaries[0],
+	})
+}
+
+// latestBatchJobs restricts a query to the jobs that haven't been rerun by their batch, so
+// that a batch's jobs cover each file once
+func latestBatchJobs(db *gorm.DB) *gorm.DB {
+	return db.Where("NOT EXISTS (SELECT 1 FROM jobs AS reruns WHERE reruns.rerun_of_id = jobs.id AND reruns.batch_id = jobs.batch_id AND reruns.deleted_at IS NULL)")
+}
+
+// loadBatch loads the batch in the URL with its pipeline, responding with an error and
+// returning false if it doesn't exist or belongs to another user
+func (h *BatchHandler) loadBatch(c *gin.Context) (models.Batch, bool) {
+	userID, exists := auth.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return models.Batch{}, false
+	}
+
+	batchID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+		return models.Batch{}, false
+	}
+
+	var batch models.Batch
+	if err := h.db.Preload("Pipeline").Preload("PipelineVersion").First(&batch, batchID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch batch"})
+		}
+		return models.Batch{}, false
+	}
+
+	if batch.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return models.Batch{}, false
+	}
+	return batch, true
+}
+
+// summarize counts the jobs of the given batches per status
+func (h *BatchHandler) summarize(batches []models.Batch) ([]BatchSummary, error) {
+	ids := make([]uint, len(batches))
+	for i, batch := range batches {
+		ids[i] = batch.ID
+	}
+
+	var rows []struct {
+		BatchID uint
+		Status  models.JobStatus
+		Count   int64
+	}
+	if len(ids) > 0 {
+		if err := h.db.Model(&models.Job{}).
+			Scopes(latestBatchJobs).
+			Select("batch_id, status, COUNT(*) AS count").
+			Where("batch_id IN ?", ids).
+			Group("batch_id, status").
+			Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	summaries := make([]BatchSummary, len(batches))
+	for i, batch := range batches {
+		summary := BatchSummary{
+			ID:         batch.ID,
+			PipelineID: batch.PipelineID,
+			Prefix:     batch.Prefix,
+			Counts:     map[string]int64{},
+			CreatedAt:  batch.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+		}
+		if len(batch.Params) > 0 {
+			if err := json.Unmarshal(batch.Params, &summary.Params); err != nil {
+				log.Printf("Failed to decode parameters of batch %d: %v", batch.ID, err)
+			}
+		}
+		if batch.Pipeline.ID > 0 {
+			summary.Pipeline = &PipelineInfo{
+				ID:     batch.Pipeline.ID,
+				Name:   batch.Pipeline.Name,
+				Format: string(batch.Pipeline.Format),
+			}
+			if batch.PipelineVersion != nil {
+				summary.Pipeline.Version = batch.PipelineVersion.Version
+				summary.Pipeline.Format = string(batch.PipelineVersion.Format)
+			}
+		}
+
+		var unfinished int64
+		for _, row := range rows {
+			if row.BatchID != batch.ID {
+				continue
+			}
+			summary.Counts[string(row.Status)] = row.Count
+			summary.Total += row.Count
+			if slices.Contains(unfinishedStatuses, row.Status) {
+				unfinished += row.Count
+			}
+		}
+
+		if summary.Total > 0 {
+			summary.Percent = float64(int(float64(summary.Total-unfinished)/float64(summary.Total)*1000+0.5)) / 10
+		}
+		summary.Status = batchStatus(summary.Counts, summary.Total, unfinished)
+		summaries[i] = summary
+	}
+	return summaries, nil
+}
+
+// batchStatus derives the status of a batch from the number of its jobs per status
+func batchStatus(counts map[string]int64, total, unfinished int64) string {
+	switch {
+	case unfinished > 0:
+		return BatchStatusRunning
+	case counts[string(models.JobStatusCompleted)] == total:
+		return BatchStatusCompleted
+	case counts[string(models.JobStatusCompleted)]+counts[string(models.JobStatusCanceled)] == total:
+		return BatchStatusCanceled
+	default:
+		return BatchStatusFailed
+	}
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
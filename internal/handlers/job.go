@@ -1,23 +1,54 @@
 package handlers
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/minio/minio-go/v7"
 	"github.com/mukund/mediaconvert/internal/auth"
+	"github.com/mukund/mediaconvert/internal/config"
 	"github.com/mukund/mediaconvert/internal/models"
+	"github.com/mukund/mediaconvert/internal/worker"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
 type JobHandler struct {
-	db *gorm.DB
+	db          *gorm.DB
+	queue       worker.Queue
+	canceller   worker.Canceller
+	minioClient *minio.Client
+	config      *config.Config
 }
 
-func NewJobHandler(db *gorm.DB) *JobHandler {
-	return &JobHandler{db: db}
+func NewJobHandler(db *gorm.DB, queue worker.Queue, canceller worker.Canceller, minioClient *minio.Client, cfg *config.Config) *JobHandler {
+	return &JobHandler{db: db, queue: queue, canceller: canceller, minioClient: minioClient, config: cfg}
+}
+
+type CreateJobRequest struct {
+	FileID     uint       `json:"file_id" binding:"required"`
+	PipelineID uint       `json:"pipeline_id" binding:"required"`
+	Priority   int        `json:"priority"`
+	Queue      string     `json:"queue"`
+	RunAt      *time.Time `json:"run_at"`     // Optional RFC 3339 time to defer the job until
+	ExpiresAt  *time.Time `json:"expires_at"` // Optional RFC 3339 deadline, overriding the pipeline's
+
+	Params map[string]interface{} `json:"params"` // Values of the pipeline's parameters
+}
+
+type RerunJobRequest struct {
+	RunAt     *time.Time             `json:"run_at"`
+	ExpiresAt *time.Time             `json:"expires_at"`
+	Params    map[string]interface{} `json:"params"` // Parameter values overriding the original job's
 }
 
 type JobListResponse struct {
@@ -38,11 +69,24 @@ type JobDetail struct {
 	PipelineID   *uint                  `json:"pipeline_id,omitempty"`
 	Pipeline     *PipelineInfo          `json:"pipeline,omitempty"`
 	PipelineData map[string]interface{} `json:"pipeline_data,omitempty"`
+	BatchID      *uint                  `json:"batch_id,omitempty"`
+	RerunOfID    *uint                  `json:"rerun_of,omitempty"` // Job this job is a rerun of
+	Params       map[string]interface{} `json:"params,omitempty"`
 	Status       string                 `json:"status"`
 	ResultInfo   map[string]interface{} `json:"result_info,omitempty"`
 	Error        string                 `json:"error,omitempty"`
+	Progress     *models.JobProgress    `json:"progress,omitempty"`
+	Attempts     int                    `json:"attempts"`
+	Priority     int                    `json:"priority"`
+	Queue        string                 `json:"queue"`
+	Capabilities []string               `json:"capabilities,omitempty"` // Capabilities a worker needs to run the job
+	WorkerID     string                 `json:"worker_id,omitempty"`
+	RunAt        *string                `json:"run_at,omitempty"`
+	ExpiresAt    *string                `json:"expires_at,omitempty"`
 	CreatedAt    string                 `json:"created_at"`
 	FinishedAt   *string                `json:"finished_at,omitempty"`
+
+	DeadLetteredAt *string `json:"dead_lettered_at,omitempty"`
 }
 
 type FileInfo struct {
@@ -56,10 +100,136 @@ type FileInfo struct {
 type PipelineInfo struct {
 	ID      uint   `json:"id"`
 	Name    string `json:"name"`
+	Version int    `json:"version,omitempty"` // Version the job runs
 	Format  string `json:"format"`
 	Content string `json:"content,omitempty"`
 }
 
+// CreateJob creates a job that runs a saved pipeline on an uploaded file
+func (h *JobHandler) CreateJob(c *gin.Context) {
+	userID, exists := auth.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req CreateJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A retried request with the same Idempotency-Key returns the job it created
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	if err := worker.ValidateIdempotencyKey(idempotencyKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	request := fmt.Sprintf("POST /api/jobs file=%d pipeline=%d", req.FileID, req.PipelineID)
+	existing, ok := findIdempotentJob(c, h.db, userID, idempotencyKey, request)
+	if !ok {
+		return
+	}
+	if existing != nil {
+		c.Header("Idempotent-Replayed", "true")
+		c.JSON(http.StatusOK, convertToJobDetail(*existing, false))
+		return
+	}
+
+	if req.Queue == "" {
+		req.Queue = models.DefaultJobQueue
+	}
+	if err := worker.ValidateJobRouting(req.Queue, req.Priority); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := worker.ValidateJobExpiry(req.ExpiresAt, req.RunAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Verify ownership of the file and pipeline
+	var file models.File
+	if err := h.db.Where("id = ? AND user_id = ?", req.FileID, userID).First(&file).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch file"})
+		}
+		return
+	}
+
+	var pipelineRecord models.Pipeline
+	if err := h.db.Where("id = ? AND user_id = ?", req.PipelineID, userID).First(&pipelineRecord).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline"})
+		}
+		return
+	}
+
+	version, err := worker.CurrentPipelineVersion(h.db, &pipelineRecord)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline version"})
+		return
+	}
+
+	params, paramsJSON, ok := resolveParams(c, version, req.Params)
+	if !ok {
+		return
+	}
+
+	if !checkQueuedLimit(c, h.db, h.config, userID, 1) {
+		return
+	}
+
+	job := models.Job{
+		FileID:            file.ID,
+		PipelineID:        &pipelineRecord.ID,
+		PipelineVersionID: &version.ID,
+		Params:            paramsJSON,
+		Status:            initialStatus(req.RunAt),
+		Priority:          req.Priority,
+		Queue:             req.Queue,
+		Capabilities:      worker.JobCapabilities(version, params),
+		RunAt:             req.RunAt,
+		ExpiresAt:         worker.JobExpiry(version, req.RunAt, req.ExpiresAt),
+	}
+
+	replayed, err := worker.CreateJobOnce(h.db, &job, userID, idempotencyKey, request, h.config.IdempotencyKeyTTL)
+	if errors.Is(err, worker.ErrIdempotencyKeyReused) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create job"})
+		return
+	}
+	if replayed {
+		// A concurrent request with the same key created the job
+		c.Header("Idempotent-Replayed", "true")
+		c.JSON(http.StatusOK, convertToJobDetail(job, false))
+		return
+	}
+
+	if err := recordStatusChange(h.db, job.ID, "", job.Status, "Job created via API", "user"); err != nil {
+		log.Printf("Failed to record status change: %v", err)
+	}
+
+	job.File = file
+	job.Pipeline = &pipelineRecord
+
+	// Enqueue job on the queue; scheduled jobs are enqueued by the scheduler once due
+	if job.Status == models.JobStatusPending && h.queue != nil {
+		if err := h.queue.Enqueue(&job); err != nil {
+			log.Printf("Failed to enqueue job %d: %v", job.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusCreated, convertToJobDetail(job, false))
+}
+
 // ListJobs returns a paginated list of jobs for the authenticated user
 func (h *JobHandler) ListJobs(c *gin.Context) {
 	userID, exists := auth.GetUserID(c)
@@ -70,6 +240,8 @@ func (h *JobHandler) ListJobs(c *gin.Context) {
 
 	// Parse query parameters
 	status := c.Query("status")
+	queue := c.Query("queue")
+	batchID := c.Query("batch_id")
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
 
@@ -90,6 +262,17 @@ func (h *JobHandler) ListJobs(c *gin.Context) {
 	if status != "" {
 		query = query.Where("jobs.status = ?", status)
 	}
+	if queue != "" {
+		query = query.Where("jobs.queue = ?", queue)
+	}
+	if batchID != "" {
+		id, err := strconv.ParseUint(batchID, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+			return
+		}
+		query = query.Where("jobs.batch_id = ?", id)
+	}
 
 	// Get total count
 	var total int64
@@ -100,6 +283,7 @@ func (h *JobHandler) ListJobs(c *gin.Context) {
 	if err := query.
 		Preload("File").
 		Preload("Pipeline").
+		Preload("PipelineVersion").
 		Order("jobs.created_at DESC").
 		Limit(limit).
 		Offset(offset).
@@ -142,6 +326,7 @@ func (h *JobHandler) GetJob(c *gin.Context) {
 	if err := h.db.
 		Preload("File").
 		Preload("Pipeline").
+		Preload("PipelineVersion").
 		First(&job, jobID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
@@ -160,7 +345,8 @@ func (h *JobHandler) GetJob(c *gin.Context) {
 	c.JSON(http.StatusOK, convertToJobDetail(job, true))
 }
 
-// CancelJob cancels a pending or processing job
+// CancelJob cancels a pending, scheduled, processing or retrying job, or gives up on a
+// dead-lettered one, taking it off the dead-letter list
 func (h *JobHandler) CancelJob(c *gin.Context) {
 	userID, exists := auth.GetUserID(c)
 	if !exists {
@@ -193,7 +379,9 @@ func (h *JobHandler) CancelJob(c *gin.Context) {
 	}
 
 	// Check if job can be cancelled
-	if job.Status != models.JobStatusPending && job.Status != models.JobStatusProcessing {
+	if job.Status != models.JobStatusPending && job.Status != models.JobStatusScheduled &&
+		job.Status != models.JobStatusProcessing && job.Status != models.JobStatusRetrying &&
+		job.Status != models.JobStatusDeadLettered {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Job cannot be cancelled (already completed or failed)"})
 		return
 	}
@@ -207,23 +395,43 @@ func (h *JobHandler) CancelJob(c *gin.Context) {
 	now := time.Now()
 	job.FinishedAt = &now
 
-	if err := h.db.Save(&job).Error; err != nil {
+	// Only update if the status hasn't moved on since it was read (e.g. the worker finished the job)
+	result := h.db.Model(&models.Job{}).
+		Where("id = ? AND status = ?", job.ID, oldStatus).
+		Updates(map[string]interface{}{
+			"status":      job.Status,
+			"error":       job.Error,
+			"finished_at": job.FinishedAt,
+		})
+	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
 		return
 	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job status changed, please retry"})
+		return
+	}
 
 	// Record status change
 	if err := recordStatusChange(h.db, job.ID, oldStatus, models.JobStatusCanceled, "Job cancelled by user", "user"); err != nil {
 		log.Printf("Failed to record status change: %v", err)
 	}
 
+	// Tell the worker running the job to stop it
+	if oldStatus == models.JobStatusProcessing && h.canceller != nil {
+		if err := h.canceller.PublishJobCancel(job.ID); err != nil {
+			log.Printf("Failed to publish cancel signal for job %d: %v", job.ID, err)
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Job cancelled successfully",
 		"job_id":  job.ID,
 	})
 }
 
-// RerunJob creates a new job with the same configuration as an existing job
+// RerunJob creates a new job with the same configuration as an existing job.
+// The new job runs immediately unless the optional request body sets run_at.
 func (h *JobHandler) RerunJob(c *gin.Context) {
 	userID, exists := auth.GetUserID(c)
 	if !exists {
@@ -237,10 +445,40 @@ func (h *JobHandler) RerunJob(c *gin.Context) {
 		return
 	}
 
+	// A retried request with the same Idempotency-Key returns the job it created
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	if err := worker.ValidateIdempotencyKey(idempotencyKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	request := fmt.Sprintf("POST /api/jobs/%d/rerun", jobID)
+	existing, ok := findIdempotentJob(c, h.db, userID, idempotencyKey, request)
+	if !ok {
+		return
+	}
+	if existing != nil {
+		c.Header("Idempotent-Replayed", "true")
+		c.JSON(http.StatusOK, rerunResponse(*existing))
+		return
+	}
+
+	var req RerunJobRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := worker.ValidateJobExpiry(req.ExpiresAt, req.RunAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	var originalJob models.Job
 	if err := h.db.
 		Preload("File").
 		Preload("Pipeline").
+		Preload("PipelineVersion").
 		First(&originalJob, jobID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
@@ -256,46 +494,425 @@ func (h *JobHandler) RerunJob(c *gin.Context) {
 		return
 	}
 
+	// Start from the original job's parameter values
+	values := make(map[string]interface{})
+	if len(originalJob.Params) > 0 {
+		if err := json.Unmarshal(originalJob.Params, &values); err != nil {
+			log.Printf("Failed to decode parameters of job %d: %v", originalJob.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode job parameters"})
+			return
+		}
+	}
+	for name, value := range req.Params {
+		values[name] = value
+	}
+	// Run the version the original job ran; jobs submitted before versions were kept
+	// run the current version
+	version := originalJob.PipelineVersion
+	if version == nil && originalJob.Pipeline != nil {
+		var err error
+		if version, err = worker.CurrentPipelineVersion(h.db, originalJob.Pipeline); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline version"})
+			return
+		}
+	}
+	var params map[string]interface{}
+	paramsJSON := originalJob.Params
+	if version != nil {
+		var ok bool
+		if params, paramsJSON, ok = resolveParams(c, version, values); !ok {
+			return
+		}
+	}
+
+	if !checkQueuedLimit(c, h.db, h.config, userID, 1) {
+		return
+	}
+
 	// Create new job with same configuration
 	newJob := models.Job{
 		FileID:       originalJob.FileID,
+		RerunOfID:    &originalJob.ID,
 		PipelineID:   originalJob.PipelineID,
 		PipelineData: originalJob.PipelineData,
-		Status:       models.JobStatusPending,
+		Params:       paramsJSON,
+		Status:       initialStatus(req.RunAt),
+		Priority:     originalJob.Priority,
+		Queue:        originalJob.Queue,
+		Capabilities: originalJob.Capabilities,
+		RunAt:        req.RunAt,
+		ExpiresAt:    req.ExpiresAt,
+	}
+	if version != nil {
+		// Parameter values may have changed
+		newJob.PipelineVersionID = &version.ID
+		newJob.Capabilities = worker.JobCapabilities(version, params)
+		newJob.ExpiresAt = worker.JobExpiry(version, req.RunAt, req.ExpiresAt)
 	}
 
-	if err := h.db.Create(&newJob).Error; err != nil {
+	replayed, err := worker.CreateJobOnce(h.db, &newJob, userID, idempotencyKey, request, h.config.IdempotencyKeyTTL)
+	if errors.Is(err, worker.ErrIdempotencyKeyReused) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create new job"})
 		return
 	}
+	if replayed {
+		// A concurrent request with the same key created the job
+		c.Header("Idempotent-Replayed", "true")
+		c.JSON(http.StatusOK, rerunResponse(newJob))
+		return
+	}
 
 	// Load the new job with relationships
 	if err := h.db.
 		Preload("File").
 		Preload("Pipeline").
+		Preload("PipelineVersion").
 		First(&newJob, newJob.ID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch new job"})
 		return
 	}
 
 	// Record initial status for new job
-	if err := recordStatusChange(h.db, newJob.ID, "", models.JobStatusPending, "Job created via rerun", "user"); err != nil {
+	if err := recordStatusChange(h.db, newJob.ID, "", newJob.Status, "Job created via rerun", "user"); err != nil {
+		log.Printf("Failed to record status change: %v", err)
+	}
+
+	// Enqueue job on the queue; scheduled jobs are enqueued by the scheduler once due
+	if newJob.Status == models.JobStatusPending && h.queue != nil {
+		if err := h.queue.Enqueue(&newJob); err != nil {
+			log.Printf("Failed to enqueue job %d: %v", newJob.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusCreated, rerunResponse(newJob))
+}
+
+// rerunResponse describes a job created by rerunning another
+func rerunResponse(newJob models.Job) gin.H {
+	response := gin.H{
+		"message": "Job rerun successfully",
+		"new_job": convertToJobDetail(newJob, false),
+	}
+	if newJob.RerunOfID != nil {
+		response["original_job"] = *newJob.RerunOfID
+	}
+	return response
+}
+
+// findIdempotentJob returns the job an earlier request with the Idempotency-Key created, or
+// nil if there is none. If the key can't be checked or was used for another request, it
+// responds with the error and returns false.
+func findIdempotentJob(c *gin.Context, db *gorm.DB, userID uint, key, request string) (*models.Job, bool) {
+	if key == "" {
+		return nil, true
+	}
+	existing, err := worker.FindIdempotentJob(db, userID, key, request)
+	if errors.Is(err, worker.ErrIdempotencyKeyReused) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+		return nil, false
+	}
+	return existing, true
+}
+
+// ListDeadLetterJobs returns the user's dead-lettered jobs, most recent first, with their
+// last error and number of attempts
+func (h *JobHandler) ListDeadLetterJobs(c *gin.Context) {
+	userID, exists := auth.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	offset := (page - 1) * limit
+
+	query := h.db.Model(&models.Job{}).
+		Joins("JOIN files ON files.id = jobs.file_id").
+		Where("files.user_id = ? AND jobs.status = ?", userID, models.JobStatusDeadLettered)
+
+	var total int64
+	query.Count(&total)
+
+	var jobs []models.Job
+	if err := query.
+		Preload("File").
+		Preload("Pipeline").
+		Preload("PipelineVersion").
+		Order("jobs.dead_lettered_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch jobs"})
+		return
+	}
+
+	jobDetails := make([]JobDetail, len(jobs))
+	for i, job := range jobs {
+		jobDetails[i] = convertToJobDetail(job, false)
+	}
+
+	c.JSON(http.StatusOK, JobListResponse{
+		Jobs: jobDetails,
+		Pagination: PaginationResponse{
+			Page:  page,
+			Limit: limit,
+			Total: total,
+		},
+	})
+}
+
+// RequeueJob releases a dead-lettered job back to the queue with a fresh set of attempts
+func (h *JobHandler) RequeueJob(c *gin.Context) {
+	userID, exists := auth.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	jobID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	var job models.Job
+	if err := h.db.
+		Preload("File").
+		Preload("Pipeline").
+		Preload("PipelineVersion").
+		First(&job, jobID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch job"})
+		}
+		return
+	}
+
+	// Verify ownership
+	if job.File.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	if job.Status != models.JobStatusDeadLettered {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only dead-lettered jobs can be requeued"})
+		return
+	}
+
+	if !checkQueuedLimit(c, h.db, h.config, userID, 1) {
+		return
+	}
+
+	// The last error stays in the history; the job starts over with its attempts reset
+	lastError := job.Error
+	job.Status = models.JobStatusPending
+	job.Error = ""
+	job.Attempts = 0
+	job.DeadLetteredAt = nil
+	result := h.db.Model(&models.Job{}).
+		Where("id = ? AND status = ?", job.ID, models.JobStatusDeadLettered).
+		Updates(map[string]interface{}{
+			"status":           job.Status,
+			"error":            job.Error,
+			"attempts":         job.Attempts,
+			"dead_lettered_at": nil,
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue job"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job status changed, please retry"})
+		return
+	}
+
+	message := "Released from dead-letter list by user"
+	if lastError != "" {
+		message += " (last error: " + lastError + ")"
+	}
+	if err := recordStatusChange(h.db, job.ID, models.JobStatusDeadLettered, models.JobStatusPending, message, "user"); err != nil {
 		log.Printf("Failed to record status change: %v", err)
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"message":      "Job rerun successfully",
-		"original_job": originalJob.ID,
-		"new_job":      convertToJobDetail(newJob, false),
+	if h.queue != nil {
+		if err := h.queue.Enqueue(&job); err != nil {
+			log.Printf("Failed to enqueue job %d: %v", job.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Job requeued successfully",
+		"job":     convertToJobDetail(job, false),
 	})
 }
 
+// ListJobLogs lists the step logs of a job
+func (h *JobHandler) ListJobLogs(c *gin.Context) {
+	logs, ok := h.loadJobLogs(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"logs": logs})
+}
+
+// GetJobLog returns the log of a single step. With ?tail=N only the last N lines are returned.
+func (h *JobHandler) GetJobLog(c *gin.Context) {
+	step, err := strconv.Atoi(c.Param("step"))
+	if err != nil || step < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid step"})
+		return
+	}
+
+	tail := 0
+	if v := c.Query("tail"); v != "" {
+		tail, err = strconv.Atoi(v)
+		if err != nil || tail < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tail must be a positive number of lines"})
+			return
+		}
+	}
+
+	logs, ok := h.loadJobLogs(c)
+	if !ok {
+		return
+	}
+
+	var stepLog *worker.StepLog
+	for i := range logs {
+		if logs[i].Step == step {
+			stepLog = &logs[i]
+		}
+	}
+	if stepLog == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Log not found"})
+		return
+	}
+
+	object, err := h.minioClient.GetObject(c.Request.Context(), h.config.S3Bucket, stepLog.S3Key, minio.GetObjectOptions{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get log"})
+		return
+	}
+	defer object.Close()
+
+	const contentType = "text/plain; charset=utf-8"
+	if tail > 0 {
+		lines, err := tailLines(object, tail)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log"})
+			return
+		}
+		c.Data(http.StatusOK, contentType, []byte(strings.Join(lines, "")))
+		return
+	}
+
+	stat, err := object.Stat()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Log not found"})
+		return
+	}
+	c.DataFromReader(http.StatusOK, stat.Size, contentType, object, nil)
+}
+
+// loadJobLogs loads the step log index of a job owned by the current user, writing an
+// error response if it can't
+func (h *JobHandler) loadJobLogs(c *gin.Context) ([]worker.StepLog, bool) {
+	userID, exists := auth.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	jobID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return nil, false
+	}
+
+	var job models.Job
+	if err := h.db.Preload("File").First(&job, jobID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch job"})
+		}
+		return nil, false
+	}
+
+	// Verify ownership
+	if job.File.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+
+	var resultInfo struct {
+		Logs []worker.StepLog `json:"logs"`
+	}
+	if len(job.ResultInfo) > 0 {
+		if err := json.Unmarshal(job.ResultInfo, &resultInfo); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read job logs"})
+			return nil, false
+		}
+	}
+	if resultInfo.Logs == nil {
+		resultInfo.Logs = []worker.StepLog{}
+	}
+
+	return resultInfo.Logs, true
+}
+
+// tailLines returns the last n lines read from r
+func tailLines(r io.Reader, n int) ([]string, error) {
+	reader := bufio.NewReader(r)
+	lines := make([]string, 0, n)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if len(lines) == n {
+				lines = lines[1:]
+			}
+			lines = append(lines, line)
+		}
+		if errors.Is(err, io.EOF) {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
 func convertToJobDetail(job models.Job, includeContent bool) JobDetail {
 	detail := JobDetail{
 		ID:        job.ID,
 		FileID:    job.FileID,
 		Status:    string(job.Status),
 		Error:     job.Error,
+		Attempts:  job.Attempts,
+		Priority:  job.Priority,
+		Queue:     job.Queue,
+		WorkerID:  job.WorkerID,
+		BatchID:   job.BatchID,
+		RerunOfID: job.RerunOfID,
 		CreatedAt: job.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
 	}
 
@@ -316,19 +933,95 @@ func convertToJobDetail(job models.Job, includeContent bool) JobDetail {
 			Name:   job.Pipeline.Name,
 			Format: string(job.Pipeline.Format),
 		}
+		content := job.Pipeline.Content
+		if job.PipelineVersion != nil {
+			detail.Pipeline.Version = job.PipelineVersion.Version
+			detail.Pipeline.Format = string(job.PipelineVersion.Format)
+			content = job.PipelineVersion.Content
+		}
 		if includeContent {
-			detail.Pipeline.Content = job.Pipeline.Content
+			detail.Pipeline.Content = content
+		}
+	}
+
+	if job.Capabilities != "" {
+		detail.Capabilities = strings.Split(job.Capabilities, ",")
+	}
+
+	if len(job.Params) > 0 {
+		json.Unmarshal(job.Params, &detail.Params)
+	}
+
+	if len(job.Progress) > 0 {
+		var progress models.JobProgress
+		if err := json.Unmarshal(job.Progress, &progress); err == nil {
+			detail.Progress = &progress
 		}
 	}
 
+	if job.RunAt != nil {
+		runAtStr := job.RunAt.Format("2006-01-02T15:04:05Z07:00")
+		detail.RunAt = &runAtStr
+	}
+	if job.ExpiresAt != nil {
+		expiresAtStr := job.ExpiresAt.Format("2006-01-02T15:04:05Z07:00")
+		detail.ExpiresAt = &expiresAtStr
+	}
+
 	if job.FinishedAt != nil {
 		finishedStr := job.FinishedAt.Format("2006-01-02T15:04:05Z07:00")
 		detail.FinishedAt = &finishedStr
 	}
 
+	if job.DeadLetteredAt != nil {
+		deadLetteredStr := job.DeadLetteredAt.Format("2006-01-02T15:04:05Z07:00")
+		detail.DeadLetteredAt = &deadLetteredStr
+	}
+
 	return detail
 }
 
+// initialStatus returns the status for a new job: scheduled if it should only run later
+func initialStatus(runAt *time.Time) models.JobStatus {
+	if runAt != nil && runAt.After(time.Now()) {
+		return models.JobStatusScheduled
+	}
+	return models.JobStatusPending
+}
+
+// resolveParams checks the parameter values supplied for a job running the saved pipeline,
+// returning the values of all its parameters. It responds with an error and returns false
+// if they are invalid.
+func resolveParams(c *gin.Context, version *models.PipelineVersion, values map[string]interface{}) (map[string]interface{}, datatypes.JSON, bool) {
+	params, err := worker.ResolveJobParams(version, values)
+	if err != nil {
+		respondInvalid(c, "Invalid pipeline parameters", err)
+		return nil, nil, false
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode pipeline parameters"})
+		return nil, nil, false
+	}
+	return params, paramsJSON, true
+}
+
+// checkQueuedLimit responds with 429 Too Many Requests and returns false if n more jobs
+// would take the user over their limit of queued jobs
+func checkQueuedLimit(c *gin.Context, db *gorm.DB, cfg *config.Config, userID uint, n int) bool {
+	err := worker.CheckQueuedLimit(db, cfg, userID, n)
+	var limitErr *worker.QueuedLimitError
+	if errors.As(err, &limitErr) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": limitErr.Error()})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check job limits"})
+		return false
+	}
+	return true
+}
+
 // recordStatusChange creates a JobStatusHistory record
 func recordStatusChange(db *gorm.DB, jobID uint, fromStatus, toStatus models.JobStatus, message, triggeredBy string) error {
 	history := models.JobStatusHistory{
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -8,7 +10,9 @@ import (
 	"github.com/mukund/mediaconvert/internal/auth"
 	"github.com/mukund/mediaconvert/internal/models"
 	"github.com/mukund/mediaconvert/internal/pipeline"
+	"github.com/mukund/mediaconvert/internal/worker"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PipelineHandler struct {
@@ -28,10 +32,24 @@ type CreatePipelineRequest struct {
 type PipelineResponse struct {
 	ID      uint   `json:"id"`
 	Name    string `json:"name"`
+	Version int    `json:"version"` // Current version
 	Format  string `json:"format"`
 	Content string `json:"content"`
 }
 
+type PipelineVersionResponse struct {
+	Version   int    `json:"version"`
+	Format    string `json:"format"`
+	Content   string `json:"content,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Current   bool   `json:"current"`
+	CreatedAt string `json:"created_at"`
+}
+
+type RollbackPipelineRequest struct {
+	Version int `json:"version" binding:"required,min=1"`
+}
+
 // CreatePipeline creates a new pipeline
 func (h *PipelineHandler) CreatePipeline(c *gin.Context) {
 	userID, exists := auth.GetUserID(c)
@@ -60,7 +78,7 @@ func (h *PipelineHandler) CreatePipeline(c *gin.Context) {
 	}
 
 	if err := p.Validate(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Pipeline validation failed: " + err.Error()})
+		respondInvalid(c, "Pipeline validation failed", err)
 		return
 	}
 
@@ -71,25 +89,32 @@ func (h *PipelineHandler) CreatePipeline(c *gin.Context) {
 		return
 	}
 
-	// Create pipeline
+	// Create pipeline with its first version
 	pipelineModel := models.Pipeline{
 		UserID:  userID,
 		Name:    req.Name,
 		Format:  models.PipelineFormat(req.Format),
 		Content: req.Content,
+		Version: 1,
 	}
 
-	if err := h.db.Create(&pipelineModel).Error; err != nil {
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&pipelineModel).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.PipelineVersion{
+			PipelineID: pipelineModel.ID,
+			Version:    1,
+			Format:     pipelineModel.Format,
+			Content:    pipelineModel.Content,
+		}).Error
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pipeline"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, PipelineResponse{
-		ID:      pipelineModel.ID,
-		Name:    pipelineModel.Name,
-		Format:  string(pipelineModel.Format),
-		Content: pipelineModel.Content,
-	})
+	c.JSON(http.StatusCreated, pipelineResponse(pipelineModel))
 }
 
 // ListPipelines returns all pipelines for the user
@@ -108,12 +133,7 @@ func (h *PipelineHandler) ListPipelines(c *gin.Context) {
 
 	response := make([]PipelineResponse, len(pipelines))
 	for i, p := range pipelines {
-		response[i] = PipelineResponse{
-			ID:      p.ID,
-			Name:    p.Name,
-			Format:  string(p.Format),
-			Content: p.Content,
-		}
+		response[i] = pipelineResponse(p)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"pipelines": response})
@@ -143,15 +163,11 @@ func (h *PipelineHandler) GetPipeline(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, PipelineResponse{
-		ID:      p.ID,
-		Name:    p.Name,
-		Format:  string(p.Format),
-		Content: p.Content,
-	})
+	c.JSON(http.StatusOK, pipelineResponse(p))
 }
 
-// UpdatePipeline updates an existing pipeline
+// UpdatePipeline updates an existing pipeline. A changed definition is added as a new
+// version; jobs already submitted keep running the version they were submitted with.
 func (h *PipelineHandler) UpdatePipeline(c *gin.Context) {
 	userID, exists := auth.GetUserID(c)
 	if !exists {
@@ -184,36 +200,161 @@ func (h *PipelineHandler) UpdatePipeline(c *gin.Context) {
 	}
 
 	if err := p.Validate(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Pipeline validation failed: " + err.Error()})
+		respondInvalid(c, "Pipeline validation failed", err)
 		return
 	}
 
-	// Find and update pipeline
+	// Find and update pipeline, locking it so that versions are numbered in order
 	var pipelineModel models.Pipeline
-	if err := h.db.Where("id = ? AND user_id = ?", pipelineID, userID).First(&pipelineModel).Error; err != nil {
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND user_id = ?", pipelineID, userID).
+			First(&pipelineModel).Error; err != nil {
+			return err
+		}
+
+		pipelineModel.Name = req.Name
+		format := models.PipelineFormat(req.Format)
+		if format != pipelineModel.Format || req.Content != pipelineModel.Content {
+			if err := addPipelineVersion(tx, &pipelineModel, format, req.Content, ""); err != nil {
+				return err
+			}
+		}
+		return tx.Save(&pipelineModel).Error
+	})
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update pipeline"})
 		}
 		return
 	}
 
-	pipelineModel.Name = req.Name
-	pipelineModel.Format = models.PipelineFormat(req.Format)
-	pipelineModel.Content = req.Content
+	c.JSON(http.StatusOK, pipelineResponse(pipelineModel))
+}
+
+// ListPipelineVersions returns the versions of a pipeline, newest first
+func (h *PipelineHandler) ListPipelineVersions(c *gin.Context) {
+	record, ok := h.loadPipeline(c)
+	if !ok {
+		return
+	}
+
+	var versions []models.PipelineVersion
+	if err := h.db.Select("id", "created_at", "pipeline_id", "version", "format", "message").
+		Where("pipeline_id = ?", record.ID).
+		Order("version DESC").
+		Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline versions"})
+		return
+	}
+
+	response := make([]PipelineVersionResponse, len(versions))
+	for i, version := range versions {
+		response[i] = pipelineVersionResponse(version, record.Version)
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": response, "current": record.Version})
+}
+
+// GetPipelineVersion returns a version of a pipeline with its definition
+func (h *PipelineHandler) GetPipelineVersion(c *gin.Context) {
+	record, ok := h.loadPipeline(c)
+	if !ok {
+		return
+	}
+	version, ok := h.loadVersion(c, record, c.Param("version"))
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, pipelineVersionResponse(version, record.Version))
+}
+
+// DiffPipelineVersions returns the changes a version of a pipeline made, as a unified diff
+// against the previous version or the version given by ?from=
+func (h *PipelineHandler) DiffPipelineVersions(c *gin.Context) {
+	record, ok := h.loadPipeline(c)
+	if !ok {
+		return
+	}
+	to, ok := h.loadVersion(c, record, c.Param("version"))
+	if !ok {
+		return
+	}
+
+	fromParam := c.Query("from")
+	if fromParam == "" {
+		if to.Version == 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Version 1 has no previous version; pass from"})
+			return
+		}
+		fromParam = strconv.Itoa(to.Version - 1)
+	}
+	from, ok := h.loadVersion(c, record, fromParam)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from": from.Version,
+		"to":   to.Version,
+		"diff": pipeline.UnifiedDiff(
+			fmt.Sprintf("version %d (%s)", from.Version, from.Format),
+			fmt.Sprintf("version %d (%s)", to.Version, to.Format),
+			from.Content, to.Content),
+	})
+}
+
+// RollbackPipeline makes an earlier version of a pipeline current again, by adding it as a
+// new version. Versions are never changed, so jobs pinned to later versions are unaffected.
+func (h *PipelineHandler) RollbackPipeline(c *gin.Context) {
+	record, ok := h.loadPipeline(c)
+	if !ok {
+		return
+	}
+
+	var req RollbackPipelineRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Version == record.Version {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Version %d is already the current version", req.Version)})
+		return
+	}
+	target, ok := h.loadVersion(c, record, strconv.Itoa(req.Version))
+	if !ok {
+		return
+	}
 
-	if err := h.db.Save(&pipelineModel).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update pipeline"})
+	// Operations may have changed since the version was created
+	p, err := worker.ParsePipeline(target.Format, target.Content)
+	if err == nil {
+		err = p.Validate()
+	}
+	if err != nil {
+		respondInvalid(c, fmt.Sprintf("Version %d is no longer valid", target.Version), err)
 		return
 	}
 
-	c.JSON(http.StatusOK, PipelineResponse{
-		ID:      pipelineModel.ID,
-		Name:    pipelineModel.Name,
-		Format:  string(pipelineModel.Format),
-		Content: pipelineModel.Content,
+	var pipelineModel models.Pipeline
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&pipelineModel, record.ID).Error; err != nil {
+			return err
+		}
+		message := fmt.Sprintf("Rolled back to version %d", target.Version)
+		if err := addPipelineVersion(tx, &pipelineModel, target.Format, target.Content, message); err != nil {
+			return err
+		}
+		return tx.Save(&pipelineModel).Error
 	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to roll back pipeline"})
+		return
+	}
+
+	c.JSON(http.StatusOK, pipelineResponse(pipelineModel))
 }
 
 // DeletePipeline deletes a pipeline
@@ -243,3 +384,108 @@ func (h *PipelineHandler) DeletePipeline(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Pipeline deleted successfully"})
 }
+
+// loadPipeline returns the user's pipeline named by the request's :id, responding with an
+// error and returning false if it can't be loaded
+func (h *PipelineHandler) loadPipeline(c *gin.Context) (models.Pipeline, bool) {
+	userID, exists := auth.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return models.Pipeline{}, false
+	}
+
+	pipelineID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pipeline ID"})
+		return models.Pipeline{}, false
+	}
+
+	var record models.Pipeline
+	if err := h.db.Where("id = ? AND user_id = ?", pipelineID, userID).First(&record).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline"})
+		}
+		return models.Pipeline{}, false
+	}
+	return record, true
+}
+
+// loadVersion returns a version of a pipeline by its number, responding with an error and
+// returning false if it can't be loaded
+func (h *PipelineHandler) loadVersion(c *gin.Context, record models.Pipeline, number string) (models.PipelineVersion, bool) {
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pipeline version"})
+		return models.PipelineVersion{}, false
+	}
+
+	var version models.PipelineVersion
+	if err := h.db.Where("pipeline_id = ? AND version = ?", record.ID, n).First(&version).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Pipeline version %d not found", n)})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline version"})
+		}
+		return models.PipelineVersion{}, false
+	}
+	return version, true
+}
+
+// addPipelineVersion adds a definition as the next version of a locked pipeline and makes
+// it current; the caller saves the pipeline
+func addPipelineVersion(tx *gorm.DB, record *models.Pipeline, format models.PipelineFormat, content, message string) error {
+	version := models.PipelineVersion{
+		PipelineID: record.ID,
+		Version:    record.Version + 1,
+		Format:     format,
+		Content:    content,
+		Message:    message,
+	}
+	if err := tx.Create(&version).Error; err != nil {
+		return err
+	}
+
+	record.Version = version.Version
+	record.Format = format
+	record.Content = content
+	return nil
+}
+
+func pipelineResponse(p models.Pipeline) PipelineResponse {
+	return PipelineResponse{
+		ID:      p.ID,
+		Name:    p.Name,
+		Version: p.Version,
+		Format:  string(p.Format),
+		Content: p.Content,
+	}
+}
+
+func pipelineVersionResponse(version models.PipelineVersion, current int) PipelineVersionResponse {
+	return PipelineVersionResponse{
+		Version:   version.Version,
+		Format:    string(version.Format),
+		Content:   version.Content,
+		Message:   version.Message,
+		Current:   version.Version == current,
+		CreatedAt: version.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+	}
+}
+
+// GetPipelineSchema returns the JSON Schema of pipeline documents
+func (h *PipelineHandler) GetPipelineSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, pipeline.JSONSchema())
+}
+
+// respondInvalid responds with 400 Bad Request, listing the invalid fields of a
+// validation error as details
+func respondInvalid(c *gin.Context, message string, err error) {
+	var validationErr *pipeline.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message + ": " + err.Error(), "details": validationErr.Errors})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": message + ": " + err.Error()})
+}
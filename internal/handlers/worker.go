@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mukund/mediaconvert/internal/worker"
+)
+
+type WorkerHandler struct {
+	workers worker.WorkerRegistry
+}
+
+func NewWorkerHandler(workers worker.WorkerRegistry) *WorkerHandler {
+	return &WorkerHandler{workers: workers}
+}
+
+// ListWorkers lists the live workers with the jobs they are running
+func (h *WorkerHandler) ListWorkers(c *gin.Context) {
+	workers, err := h.workers.ListWorkers(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"workers": workers})
+}
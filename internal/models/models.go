@@ -11,6 +11,11 @@ type User struct {
 	gorm.Model
 	Email    string `gorm:"uniqueIndex;not null"`
 	Password string `gorm:"not null"` // Hashed
+	IsAdmin  bool   `gorm:"not null;default:false"`
+
+	// Limits on the user's jobs, overriding the configured defaults when set (0 means no limit)
+	MaxConcurrentJobs *int // Jobs that may run at once
+	MaxQueuedJobs     *int // Jobs that may wait to run
 }
 
 type File struct {
@@ -31,6 +36,19 @@ const (
 	JobStatusCompleted  JobStatus = "completed"
 	JobStatusFailed     JobStatus = "failed"
 	JobStatusCanceled   JobStatus = "canceled"
+	JobStatusRetrying   JobStatus = "retrying"  // Failed with a transient error, waiting to be run again
+	JobStatusScheduled  JobStatus = "scheduled" // Waiting for its RunAt time before being queued
+
+	// Exhausted its retries or kept crashing workers; held until a user requeues it
+	JobStatusDeadLettered JobStatus = "dead_lettered"
+	// Reached its expires_at time before a worker started it
+	JobStatusExpired JobStatus = "expired"
+)
+
+const (
+	DefaultJobQueue = "default"
+	MinJobPriority  = -5
+	MaxJobPriority  = 5 // Workers always take jobs with a higher priority first
 )
 
 type PipelineFormat string
@@ -45,8 +63,20 @@ type Pipeline struct {
 	UserID  uint
 	User    User
 	Name    string         `gorm:"not null"`
-	Format  PipelineFormat `gorm:"type:varchar(10);not null"`
-	Content string         `gorm:"type:text;not null"`
+	Format  PipelineFormat `gorm:"type:varchar(10);not null"` // Format of the current version
+	Content string         `gorm:"type:text;not null"`        // Definition of the current version
+	Version int            `gorm:"not null;default:1"`        // Number of the current version
+}
+
+// PipelineVersion is an immutable revision of a pipeline's definition. Changing or rolling
+// back a pipeline adds a version; jobs run the version they were submitted with.
+type PipelineVersion struct {
+	gorm.Model
+	PipelineID uint           `gorm:"not null;uniqueIndex:idx_pipeline_versions_number"`
+	Version    int            `gorm:"not null;uniqueIndex:idx_pipeline_versions_number"` // 1 for the first version
+	Format     PipelineFormat `gorm:"type:varchar(10);not null"`
+	Content    string         `gorm:"type:text;not null"`
+	Message    string         // How the version came about, e.g. "Rolled back to version 2"
 }
 
 type Job struct {
@@ -55,11 +85,65 @@ type Job struct {
 	File         File
 	PipelineID   *uint          // Optional reference to a saved pipeline
 	Pipeline     *Pipeline      // Relationship to saved pipeline
+
+	// Version of the saved pipeline the job runs; unset for jobs submitted before versions
+	// were kept, which run the current version
+	PipelineVersionID *uint `gorm:"index"`
+	PipelineVersion   *PipelineVersion
+
+	// Job this job is a rerun of, if any
+	RerunOfID *uint `gorm:"index"`
+
 	PipelineData datatypes.JSON // Inline pipeline definition (for ad-hoc jobs or snapshot)
+	BatchID      *uint          `gorm:"index"` // Batch the job was created by, if any
+	Params       datatypes.JSON // Values of the pipeline's parameters, as resolved on submission
 	Status       JobStatus      `gorm:"default:'pending'"`
 	ResultInfo   datatypes.JSON // JSON storing result details (e.g., output paths)
+	Progress     datatypes.JSON // JobProgress reported by the worker while the job runs
 	Error        string
+	Attempts     int        `gorm:"not null;default:0"` // Number of times a worker started the job
+	Priority     int        `gorm:"not null;default:0;index"`
+	Queue        string     `gorm:"type:varchar(50);not null;default:'default'"`
+	Capabilities string     `gorm:"type:varchar(500);not null;default:''"` // Capabilities a worker needs to run the job (comma-separated)
+	RunAt        *time.Time `gorm:"index"` // Earliest time the job may run (scheduled jobs)
+	ExpiresAt    *time.Time `gorm:"index"` // Deadline: the job expires if still waiting, or is cancelled if still running
 	FinishedAt   *time.Time
+
+	DeadLetteredAt *time.Time `gorm:"index"` // When the job was moved to the dead-letter list
+
+	// Lease held by the worker processing the job, renewed by heartbeats
+	LeaseOwner     string     `gorm:"type:varchar(255)"`
+	LeaseExpiresAt *time.Time `gorm:"index"`
+
+	WorkerID string `gorm:"type:varchar(255);index"` // Worker that last ran the job
+}
+
+// Batch runs a saved pipeline on many files as one unit, with a job per file
+type Batch struct {
+	gorm.Model
+	UserID     uint
+	User       User
+	PipelineID uint
+	Pipeline   Pipeline
+
+	// Version of the pipeline the jobs run
+	PipelineVersionID *uint
+	PipelineVersion   *PipelineVersion
+
+	Prefix string         // S3 key prefix the files were selected by, if any
+	Params datatypes.JSON // Values of the pipeline's parameters the jobs run with
+	Jobs   []Job
+}
+
+// JobProgress is the live progress of a job, stored as JSON on the job
+type JobProgress struct {
+	Step        int       `json:"step"`                   // 1-based index of the running step
+	TotalSteps  int       `json:"total_steps"`            // Number of steps in the pipeline
+	StepName    string    `json:"step_name"`              // Operation of the running step
+	StepPercent *float64  `json:"step_percent,omitempty"` // Only set for steps whose tool reports progress
+	Percent     float64   `json:"percent"`                // Progress of the whole pipeline
+	ETASeconds  *int64    `json:"eta_seconds,omitempty"`  // Estimated time until the pipeline finishes
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 type JobStatusHistory struct {
@@ -81,3 +165,43 @@ type S3Credential struct {
 	BucketName string `gorm:"uniqueIndex;not null"`
 	IsActive   bool   `gorm:"default:true"`
 }
+
+// IdempotencyKey records the job created for a client-supplied idempotency key, so that a
+// retried request returns that job instead of creating a duplicate. Keys are unique per
+// user until they expire, and only replay the request they were first used for.
+type IdempotencyKey struct {
+	ID        uint      `gorm:"primarykey"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_idempotency_keys_user_key"`
+	Key       string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_idempotency_keys_user_key"`
+	JobID     uint      `gorm:"not null"`
+	Job       Job
+
+	// Request the key was first used for, e.g. "POST /api/jobs/3/rerun"
+	Request string `gorm:"type:text;not null;default:''"`
+
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// QueuedJob is an entry of the PostgreSQL job queue. Workers lease entries with
+// SELECT ... FOR UPDATE SKIP LOCKED and delete them once the job is handled.
+type QueuedJob struct {
+	ID             uint64    `gorm:"primarykey"`
+	JobID          uint      `gorm:"not null;index"`
+	Queue          string    `gorm:"type:varchar(50);not null;index:idx_queued_jobs_dispatch"`
+	Priority       int       `gorm:"not null"`
+	UserID         uint      `gorm:"not null"`
+	Capabilities   string    `gorm:"type:varchar(500);not null;default:''"` // Capabilities a worker needs (comma-separated)
+	AvailableAt    time.Time `gorm:"not null;index:idx_queued_jobs_dispatch"` // When the entry may be handed out
+	LeaseOwner     string    `gorm:"type:varchar(255)"`
+	LeaseExpiresAt *time.Time
+	CreatedAt      time.Time
+}
+
+// WorkerRegistration is a worker's registration in the PostgreSQL worker registry
+type WorkerRegistration struct {
+	ID        string         `gorm:"primarykey;type:varchar(255)"`
+	Info      datatypes.JSON `gorm:"not null"` // Registration as published in heartbeats
+	LastSeen  time.Time      `gorm:"not null"`
+	ExpiresAt time.Time      `gorm:"not null;index"` // The worker is considered gone after this
+}
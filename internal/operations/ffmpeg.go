@@ -0,0 +1,114 @@
+package operations
+
+import (
+	"github.com/mukund/mediaconvert/internal/pipeline"
+	"github.com/mukund/mediaconvert/internal/system"
+)
+
+// Transcode transcodes video and audio with ffmpeg
+type Transcode struct{}
+
+func (Transcode) Name() string { return "transcode" }
+
+func (Transcode) Schema() pipeline.OperationSchema {
+	return pipeline.OperationSchema{
+		Description: "Transcode video and audio with ffmpeg",
+		Params: map[string]pipeline.ParamSchema{
+			"codec":         withDescription(codecParam, "Video codec (h264, h265, vp9) or ffmpeg encoder, e.g. libx264"),
+			"quality":       {Type: pipeline.ParamTypeInteger, Min: bound(0), Max: bound(63), Description: "Constant rate factor; lower is better"},
+			"audio_codec":   withDescription(codecParam, "ffmpeg audio encoder, e.g. aac"),
+			"audio_bitrate": {Type: pipeline.ParamTypeString, Pattern: `^[0-9]+(\.[0-9]+)?[kKM]?$`, Description: "Audio bitrate, e.g. 128k"},
+		},
+	}
+}
+
+func (Transcode) Capabilities(step pipeline.Step) []string {
+	capabilities := []string{system.CapabilityFFmpeg}
+	if codec, ok := step.Params["codec"].(string); ok {
+		capabilities = append(capabilities, encoderCapabilities(videoEncoder(codec))...)
+	}
+	if codec, ok := step.Params["audio_codec"].(string); ok {
+		capabilities = append(capabilities, encoderCapabilities(codec)...)
+	}
+	return capabilities
+}
+
+func (Transcode) Command(step pipeline.Step) (*pipeline.Command, error) {
+	args := []string{"-i", step.Input}
+
+	// Map codec
+	if codec, ok := step.Params["codec"].(string); ok {
+		args = append(args, "-c:v", videoEncoder(codec))
+	}
+
+	// Map quality (CRF for video)
+	if crf, ok := intParam(step.Params["quality"]); ok {
+		args = append(args, "-crf", crf)
+	}
+
+	// Audio codec
+	if audioCodec, ok := step.Params["audio_codec"].(string); ok {
+		args = append(args, "-c:a", audioCodec)
+	}
+
+	// Audio bitrate
+	if audioBitrate, ok := step.Params["audio_bitrate"].(string); ok {
+		args = append(args, "-b:a", audioBitrate)
+	}
+
+	args = append(args, step.Output)
+
+	return &pipeline.Command{
+		Tool: "ffmpeg",
+		Args: args,
+	}, nil
+}
+
+// videoEncoder maps a codec name used in pipelines to the ffmpeg encoder for it
+func videoEncoder(codec string) string {
+	switch codec {
+	case "h264":
+		return "libx264"
+	case "h265":
+		return "libx265"
+	case "vp9":
+		return "libvpx-vp9"
+	default:
+		return codec
+	}
+}
+
+// ExtractFrame extracts a frame of a video with ffmpeg
+type ExtractFrame struct{}
+
+func (ExtractFrame) Name() string { return "extract_frame" }
+
+func (ExtractFrame) Schema() pipeline.OperationSchema {
+	return pipeline.OperationSchema{
+		Description: "Extract a frame of a video with ffmpeg",
+		Params: map[string]pipeline.ParamSchema{
+			"timestamp": timestampParam,
+		},
+	}
+}
+
+func (ExtractFrame) Capabilities(pipeline.Step) []string {
+	return []string{system.CapabilityFFmpeg}
+}
+
+func (ExtractFrame) Command(step pipeline.Step) (*pipeline.Command, error) {
+	args := []string{"-i", step.Input}
+
+	// Timestamp
+	if timestamp, ok := step.Params["timestamp"].(string); ok {
+		args = append(args, "-ss", timestamp)
+	}
+
+	args = append(args, "-vframes", "1")
+	args = append(args, step.Output)
+
+	return &pipeline.Command{
+		Tool: "ffmpeg",
+		Args: args,
+	}, nil
+}
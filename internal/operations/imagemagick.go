@@ -0,0 +1,71 @@
+package operations
+
+import (
+	"fmt"
+
+	"github.com/mukund/mediaconvert/internal/pipeline"
+	"github.com/mukund/mediaconvert/internal/system"
+)
+
+// Resize resizes an image with ImageMagick
+type Resize struct{}
+
+func (Resize) Name() string { return "resize" }
+
+func (Resize) Schema() pipeline.OperationSchema {
+	return pipeline.OperationSchema{
+		Description: "Resize an image with ImageMagick",
+		Params: map[string]pipeline.ParamSchema{
+			"width":   widthParam,
+			"height":  heightParam,
+			"quality": {Type: pipeline.ParamTypeInteger, Min: bound(1), Max: bound(100), Description: "Output quality (JPEG, WebP)"},
+		},
+	}
+}
+
+func (Resize) Capabilities(pipeline.Step) []string {
+	return []string{system.CapabilityImageMagick}
+}
+
+func (Resize) Command(step pipeline.Step) (*pipeline.Command, error) {
+	args := []string{step.Input}
+
+	if width, height, ok := size(step); ok {
+		args = append(args, "-resize", fmt.Sprintf("%vx%v", width, height))
+	}
+
+	// Quality
+	if quality, ok := step.Params["quality"]; ok {
+		args = append(args, "-quality", fmt.Sprintf("%v", quality))
+	}
+
+	args = append(args, step.Output)
+
+	return &pipeline.Command{
+		Tool: "convert",
+		Args: args,
+	}, nil
+}
+
+// Convert converts an image to the format of the output's extension with ImageMagick
+type Convert struct{}
+
+func (Convert) Name() string { return "convert" }
+
+func (Convert) Schema() pipeline.OperationSchema {
+	return pipeline.OperationSchema{
+		Description: "Convert an image to the output's format with ImageMagick",
+		Params:      map[string]pipeline.ParamSchema{},
+	}
+}
+
+func (Convert) Capabilities(pipeline.Step) []string {
+	return []string{system.CapabilityImageMagick}
+}
+
+func (Convert) Command(step pipeline.Step) (*pipeline.Command, error) {
+	return &pipeline.Command{
+		Tool: "convert",
+		Args: []string{step.Input, step.Output},
+	}, nil
+}
@@ -0,0 +1,62 @@
+// Package operations implements the built-in pipeline operations, registering them with
+// the pipeline package when imported.
+package operations
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/mukund/mediaconvert/internal/pipeline"
+	"github.com/mukund/mediaconvert/internal/system"
+)
+
+func init() {
+	pipeline.RegisterOperation(Transcode{})
+	pipeline.RegisterOperation(ExtractFrame{})
+	pipeline.RegisterOperation(Resize{})
+	pipeline.RegisterOperation(Convert{})
+	pipeline.RegisterOperation(ExtractText{})
+	pipeline.RegisterOperation(GenerateThumbnail{})
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+var (
+	codecParam     = pipeline.ParamSchema{Type: pipeline.ParamTypeString, Pattern: `^[A-Za-z0-9_-]+$`}
+	timestampParam = pipeline.ParamSchema{Type: pipeline.ParamTypeString, Pattern: `^[0-9]+(:[0-9]{1,2}){0,2}(\.[0-9]+)?$`, Description: "Position in the input, e.g. 00:00:01 or 1.5"}
+	widthParam     = pipeline.ParamSchema{Type: pipeline.ParamTypeInteger, Min: bound(1), Max: bound(16384), Description: "Width in pixels"}
+	heightParam    = pipeline.ParamSchema{Type: pipeline.ParamTypeInteger, Min: bound(1), Max: bound(16384), Description: "Height in pixels"}
+)
+
+func withDescription(schema pipeline.ParamSchema, description string) pipeline.ParamSchema {
+	schema.Description = description
+	return schema
+}
+
+// size returns the width and height params of a step, if it has both
+func size(step pipeline.Step) (width, height interface{}, ok bool) {
+	width, hasWidth := step.Params["width"]
+	height, hasHeight := step.Params["height"]
+	return width, height, hasWidth && hasHeight
+}
+
+// encoderCapabilities returns the capability for an encoder, if it is one workers probe for
+func encoderCapabilities(encoder string) []string {
+	if slices.Contains(system.Encoders, encoder) {
+		return []string{system.EncoderCapability(encoder)}
+	}
+	return nil
+}
+
+// intParam formats a numeric param as an integer argument
+func intParam(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case float64:
+		return fmt.Sprintf("%.0f", v), true
+	case int:
+		return fmt.Sprintf("%d", v), true
+	}
+	return "", false
+}
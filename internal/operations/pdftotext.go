@@ -0,0 +1,29 @@
+package operations
+
+import (
+	"github.com/mukund/mediaconvert/internal/pipeline"
+	"github.com/mukund/mediaconvert/internal/system"
+)
+
+// ExtractText extracts the text of a PDF with pdftotext
+type ExtractText struct{}
+
+func (ExtractText) Name() string { return "extract_text" }
+
+func (ExtractText) Schema() pipeline.OperationSchema {
+	return pipeline.OperationSchema{
+		Description: "Extract the text of a PDF with pdftotext",
+		Params:      map[string]pipeline.ParamSchema{},
+	}
+}
+
+func (ExtractText) Capabilities(pipeline.Step) []string {
+	return []string{system.CapabilityPDFToText}
+}
+
+func (ExtractText) Command(step pipeline.Step) (*pipeline.Command, error) {
+	return &pipeline.Command{
+		Tool: "pdftotext",
+		Args: []string{step.Input, step.Output},
+	}, nil
+}
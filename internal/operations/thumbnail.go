@@ -0,0 +1,89 @@
+package operations
+
+import (
+	"fmt"
+
+	"github.com/mukund/mediaconvert/internal/pipeline"
+	"github.com/mukund/mediaconvert/internal/system"
+)
+
+// GenerateThumbnail generates a thumbnail of a video with ffmpeg, or of an image or the
+// first page of a PDF with ImageMagick
+type GenerateThumbnail struct{}
+
+func (GenerateThumbnail) Name() string { return "generate_thumbnail" }
+
+func (GenerateThumbnail) Schema() pipeline.OperationSchema {
+	return pipeline.OperationSchema{
+		Description: "Generate a thumbnail of a video, image or PDF",
+		Params: map[string]pipeline.ParamSchema{
+			"type":      {Type: pipeline.ParamTypeString, Enum: []string{"video", "image", "pdf"}, Description: "Kind of input (default video)"},
+			"timestamp": timestampParam,
+			"width":     widthParam,
+			"height":    heightParam,
+		},
+	}
+}
+
+func (GenerateThumbnail) Capabilities(step pipeline.Step) []string {
+	if thumbnailType(step) != "video" {
+		return []string{system.CapabilityImageMagick}
+	}
+	return []string{system.CapabilityFFmpeg}
+}
+
+func (GenerateThumbnail) Command(step pipeline.Step) (*pipeline.Command, error) {
+	switch inputType := thumbnailType(step); inputType {
+	case "video":
+		// Use FFmpeg to extract frame from video
+		args := []string{"-i", step.Input}
+
+		// Timestamp (default to 1 second)
+		timestamp := "00:00:01"
+		if t, ok := step.Params["timestamp"].(string); ok {
+			timestamp = t
+		}
+		args = append(args, "-ss", timestamp)
+
+		if width, height, ok := size(step); ok {
+			args = append(args, "-vf", fmt.Sprintf("scale=%v:%v", width, height))
+		}
+
+		args = append(args, "-vframes", "1", step.Output)
+
+		return &pipeline.Command{
+			Tool: "ffmpeg",
+			Args: args,
+		}, nil
+
+	case "image", "pdf":
+		// Use ImageMagick to resize the image, or the first page of the PDF
+		input := step.Input
+		if inputType == "pdf" {
+			input += "[0]"
+		}
+		args := []string{input}
+
+		if width, height, ok := size(step); ok {
+			args = append(args, "-resize", fmt.Sprintf("%vx%v", width, height))
+		}
+
+		args = append(args, step.Output)
+
+		return &pipeline.Command{
+			Tool: "convert",
+			Args: args,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported thumbnail type: %s", inputType)
+	}
+}
+
+// thumbnailType returns the kind of input of a thumbnail step, video by default
+func thumbnailType(step pipeline.Step) string {
+	if t, ok := step.Params["type"].(string); ok {
+		return t
+	}
+	return "video"
+}
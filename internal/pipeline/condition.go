@@ -0,0 +1,396 @@
+package pipeline
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// MediaProperties describes a job's input file, for evaluating step conditions.
+// Properties that couldn't be probed are zero.
+type MediaProperties struct {
+	ContentType string
+	Size        int64   // Bytes
+	Width       int     // Pixels
+	Height      int     // Pixels
+	Duration    float64 // Seconds
+	VideoCodec  string
+	AudioCodec  string
+}
+
+// Condition is a parsed `when` expression, such as
+// `width > 1920 && video_codec != "hevc"` or `content_type matches "image/*"`.
+//
+// Expressions compare the input's properties (content_type, size, width, height,
+// duration, video_codec, audio_codec) with numbers and quoted strings using ==, !=, <, <=,
+// >, >= and matches (a glob), and combine comparisons with &&, || and !.
+type Condition struct {
+	source string
+	root   *conditionNode
+}
+
+type conditionType int
+
+const (
+	conditionBool conditionType = iota
+	conditionNumber
+	conditionString
+)
+
+func (t conditionType) String() string {
+	switch t {
+	case conditionNumber:
+		return "number"
+	case conditionString:
+		return "string"
+	default:
+		return "boolean"
+	}
+}
+
+type conditionValue struct {
+	b bool
+	n float64
+	s string
+}
+
+type conditionNode struct {
+	typ  conditionType
+	eval func(props MediaProperties) conditionValue
+}
+
+// conditionVars are the properties conditions can refer to
+var conditionVars = map[string]*conditionNode{
+	"content_type": {conditionString, func(p MediaProperties) conditionValue { return conditionValue{s: p.ContentType} }},
+	"size":         {conditionNumber, func(p MediaProperties) conditionValue { return conditionValue{n: float64(p.Size)} }},
+	"width":        {conditionNumber, func(p MediaProperties) conditionValue { return conditionValue{n: float64(p.Width)} }},
+	"height":       {conditionNumber, func(p MediaProperties) conditionValue { return conditionValue{n: float64(p.Height)} }},
+	"duration":     {conditionNumber, func(p MediaProperties) conditionValue { return conditionValue{n: p.Duration} }},
+	"video_codec":  {conditionString, func(p MediaProperties) conditionValue { return conditionValue{s: p.VideoCodec} }},
+	"audio_codec":  {conditionString, func(p MediaProperties) conditionValue { return conditionValue{s: p.AudioCodec} }},
+}
+
+// ParseCondition parses and type-checks a `when` expression
+func ParseCondition(source string) (*Condition, error) {
+	tokens, err := tokenizeCondition(source)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &conditionParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := parser.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+	if root.typ != conditionBool {
+		return nil, fmt.Errorf("expression is a %s, not a condition", root.typ)
+	}
+	return &Condition{source: source, root: root}, nil
+}
+
+// Eval reports whether the condition holds for the given input
+func (c *Condition) Eval(props MediaProperties) bool {
+	return c.root.eval(props).b
+}
+
+func (c *Condition) String() string {
+	return c.source
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type conditionToken struct {
+	kind tokenKind
+	text string // Operator or identifier; the unquoted value of strings
+	num  float64
+	pos  int
+}
+
+func (t conditionToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// conditionOps are the operators, longest first so that "<=" isn't read as "<"
+var conditionOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+// comparisonOps are the operators that compare two values
+var comparisonOps = []string{"==", "!=", "<", "<=", ">", ">="}
+
+func tokenizeCondition(source string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	i := 0
+
+next:
+	for i < len(source) {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			for j := i + 1; j < len(source); j++ {
+				switch source[j] {
+				case '\\':
+					if j+1 < len(source) {
+						j++
+						b.WriteByte(source[j])
+					}
+				case source[i]:
+					tokens = append(tokens, conditionToken{kind: tokenString, text: b.String(), pos: i})
+					i = j + 1
+					continue next
+				default:
+					b.WriteByte(source[j])
+				}
+			}
+			return nil, fmt.Errorf("unterminated string at position %d", i)
+
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(source) && (unicode.IsDigit(rune(source[j])) || source[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(source[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", source[i:j], i)
+			}
+			tokens = append(tokens, conditionToken{kind: tokenNumber, text: source[i:j], num: n, pos: i})
+			i = j
+
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(source) && (unicode.IsLetter(rune(source[j])) || unicode.IsDigit(rune(source[j])) || source[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, conditionToken{kind: tokenIdent, text: source[i:j], pos: i})
+			i = j
+
+		default:
+			for _, op := range conditionOps {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, conditionToken{kind: tokenOp, text: op, pos: i})
+					i += len(op)
+					continue next
+				}
+			}
+			return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+		}
+	}
+
+	return append(tokens, conditionToken{kind: tokenEOF, pos: len(source)}), nil
+}
+
+// conditionParser parses conditions by recursive descent:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "matches" ) operand ]
+//	operand    = property | number | string | "true" | "false" | "(" or ")"
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+func (p *conditionParser) peek() conditionToken {
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() conditionToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *conditionParser) isOp(op string) bool {
+	tok := p.peek()
+	return tok.kind == tokenOp && tok.text == op
+}
+
+func (p *conditionParser) parseOr() (*conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		op := p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkOperands(op, conditionBool, left, right); err != nil {
+			return nil, err
+		}
+		l, r := left, right
+		left = &conditionNode{conditionBool, func(props MediaProperties) conditionValue {
+			return conditionValue{b: l.eval(props).b || r.eval(props).b}
+		}}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (*conditionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		op := p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkOperands(op, conditionBool, left, right); err != nil {
+			return nil, err
+		}
+		l, r := left, right
+		left = &conditionNode{conditionBool, func(props MediaProperties) conditionValue {
+			return conditionValue{b: l.eval(props).b && r.eval(props).b}
+		}}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseUnary() (*conditionNode, error) {
+	if !p.isOp("!") {
+		return p.parseComparison()
+	}
+	op := p.next()
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOperands(op, conditionBool, operand); err != nil {
+		return nil, err
+	}
+	return &conditionNode{conditionBool, func(props MediaProperties) conditionValue {
+		return conditionValue{b: !operand.eval(props).b}
+	}}, nil
+}
+
+func (p *conditionParser) parseComparison() (*conditionNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	isComparison := tok.kind == tokenOp && slices.Contains(comparisonOps, tok.text)
+	if !isComparison && !(tok.kind == tokenIdent && tok.text == "matches") {
+		return left, nil
+	}
+	op := p.next()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	l, r := left, right
+	var compare func(a, b conditionValue) bool
+	switch op.text {
+	case "==", "!=":
+		if err := checkOperands(op, left.typ, right); err != nil {
+			return nil, err
+		}
+		equal := func(a, b conditionValue) bool { return a == b }
+		compare = equal
+		if op.text == "!=" {
+			compare = func(a, b conditionValue) bool { return !equal(a, b) }
+		}
+	case "matches":
+		if err := checkOperands(op, conditionString, left, right); err != nil {
+			return nil, err
+		}
+		compare = func(a, b conditionValue) bool {
+			matched, _ := path.Match(b.s, a.s)
+			return matched
+		}
+	default:
+		if err := checkOperands(op, conditionNumber, left, right); err != nil {
+			return nil, err
+		}
+		compare = map[string]func(a, b conditionValue) bool{
+			"<":  func(a, b conditionValue) bool { return a.n < b.n },
+			"<=": func(a, b conditionValue) bool { return a.n <= b.n },
+			">":  func(a, b conditionValue) bool { return a.n > b.n },
+			">=": func(a, b conditionValue) bool { return a.n >= b.n },
+		}[op.text]
+	}
+
+	return &conditionNode{conditionBool, func(props MediaProperties) conditionValue {
+		return conditionValue{b: compare(l.eval(props), r.eval(props))}
+	}}, nil
+}
+
+func (p *conditionParser) parseOperand() (*conditionNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenNumber:
+		value := conditionValue{n: tok.num}
+		return &conditionNode{conditionNumber, func(MediaProperties) conditionValue { return value }}, nil
+
+	case tokenString:
+		value := conditionValue{s: tok.text}
+		return &conditionNode{conditionString, func(MediaProperties) conditionValue { return value }}, nil
+
+	case tokenIdent:
+		switch tok.text {
+		case "true", "false":
+			value := conditionValue{b: tok.text == "true"}
+			return &conditionNode{conditionBool, func(MediaProperties) conditionValue { return value }}, nil
+		}
+		if node, ok := conditionVars[tok.text]; ok {
+			return node, nil
+		}
+		return nil, fmt.Errorf("unknown property %q at position %d", tok.text, tok.pos)
+
+	case tokenOp:
+		if tok.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isOp(")") {
+				closing := p.peek()
+				return nil, fmt.Errorf("expected \")\" at position %d, found %s", closing.pos, closing)
+			}
+			p.next()
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+}
+
+// checkOperands returns an error unless all operands of op are of type want
+func checkOperands(op conditionToken, want conditionType, operands ...*conditionNode) error {
+	for _, operand := range operands {
+		if operand.typ != want {
+			return fmt.Errorf("%q at position %d expects %s operands, not %s", op.text, op.pos, want, operand.typ)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package pipeline
+
+import "testing"
+
+func TestConditionEval(t *testing.T) {
+	video := MediaProperties{
+		ContentType: "video/mp4",
+		Size:        50 << 20,
+		Width:       3840,
+		Height:      2160,
+		Duration:    90.5,
+		VideoCodec:  "hevc",
+		AudioCodec:  "aac",
+	}
+
+	tests := []struct {
+		when string
+		want bool
+	}{
+		{`width > 1920`, true},
+		{`width >= 3840 && height <= 2160`, true},
+		{`width < 3840`, false},
+		{`duration == 90.5`, true},
+		{`size != 0`, true},
+		{`video_codec == "hevc"`, true},
+		{`video_codec == 'h264'`, false},
+		{`audio_codec != "opus"`, true},
+		{`true`, true},
+		{`false`, false},
+
+		// && binds tighter than ||
+		{`true || true && false`, true},
+		{`false && true || true`, true},
+		{`(true || true) && false`, false},
+		{`false || false || true`, true},
+
+		// ! binds tighter than && and ||, and applies to comparisons
+		{`!false`, true},
+		{`!!true`, true},
+		{`!width > 1920`, false},
+		{`!(width > 1920) || height > 1000`, true},
+		{`!true && false || true`, true},
+		{`!(true && false)`, true},
+
+		// matches is a glob on the whole string
+		{`content_type matches "video/*"`, true},
+		{`content_type matches "image/*"`, false},
+		{`content_type matches "video/mp?"`, true},
+		{`content_type matches "*/mp4"`, true},
+		{`content_type matches "video"`, false},
+		{`content_type matches "video/[a-m]*"`, true},
+		{`content_type matches "["`, false}, // Malformed patterns match nothing
+		{`video_codec matches "h*" || video_codec matches "hevc"`, true},
+
+		// Strings
+		{`video_codec == "he\vc"`, true},
+		{`video_codec == "say \"hi\""`, false},
+		{`"a b" == "a b"`, true},
+		{`"" == audio_codec`, false},
+	}
+
+	for _, tt := range tests {
+		condition, err := ParseCondition(tt.when)
+		if err != nil {
+			t.Errorf("ParseCondition(%q): %v", tt.when, err)
+			continue
+		}
+		if got := condition.Eval(video); got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.when, got, tt.want)
+		}
+	}
+}
+
+func TestConditionUnprobedProperties(t *testing.T) {
+	// Properties that couldn't be probed are zero
+	tests := []struct {
+		when string
+		want bool
+	}{
+		{`width == 0`, true},
+		{`width > 0`, false},
+		{`video_codec == ""`, true},
+		{`content_type matches "*"`, true},
+	}
+
+	for _, tt := range tests {
+		condition, err := ParseCondition(tt.when)
+		if err != nil {
+			t.Errorf("ParseCondition(%q): %v", tt.when, err)
+			continue
+		}
+		if got := condition.Eval(MediaProperties{}); got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.when, got, tt.want)
+		}
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	tests := []struct {
+		when string
+		want string
+	}{
+		// Tokens
+		{`video_codec == "hevc`, `unterminated string at position 15`},
+		{`video_codec == 'hevc"`, `unterminated string at position 15`},
+		{`"abc\"`, `unterminated string at position 0`},
+		{`width > 1.2.3`, `invalid number "1.2.3" at position 8`},
+		{`width > 10 # comment`, `unexpected '#' at position 11`},
+		{`width = 10`, `unexpected '=' at position 6`},
+		{`width & 10`, `unexpected '&' at position 6`},
+
+		// Syntax
+		{``, `unexpected end of expression at position 0`},
+		{`width >`, `unexpected end of expression at position 7`},
+		{`(width > 10`, `expected ")" at position 11, found end of expression`},
+		{`width > 10)`, `unexpected ")" at position 10`},
+		{`width > 10 height < 5`, `unexpected "height" at position 11`},
+		{`&& true`, `unexpected "&&" at position 0`},
+		{`width > 10 > 5`, `unexpected ">" at position 11`},
+		{`bitrate > 10`, `unknown property "bitrate" at position 0`},
+		{`width > height > `, `unexpected ">" at position 15`},
+
+		// Types
+		{`width`, `expression is a number, not a condition`},
+		{`"video"`, `expression is a string, not a condition`},
+		{`width > "1920"`, `">" at position 6 expects number operands, not string`},
+		{`video_codec < 3`, `"<" at position 12 expects number operands, not string`},
+		{`width == "1920"`, `"==" at position 6 expects number operands, not string`},
+		{`true == 1`, `"==" at position 5 expects boolean operands, not number`},
+		{`width matches "1*"`, `"matches" at position 6 expects string operands, not number`},
+		{`content_type matches 1`, `"matches" at position 13 expects string operands, not number`},
+		{`width && true`, `"&&" at position 6 expects boolean operands, not number`},
+		{`true || "yes"`, `"||" at position 5 expects boolean operands, not string`},
+		{`!width`, `"!" at position 0 expects boolean operands, not number`},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseCondition(tt.when)
+		if err == nil {
+			t.Errorf("ParseCondition(%q) succeeded, want error %q", tt.when, tt.want)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("ParseCondition(%q) error = %q, want %q", tt.when, err, tt.want)
+		}
+	}
+}
+
+func TestConditionString(t *testing.T) {
+	const when = `width > 1920 && content_type matches "video/*"`
+	condition, err := ParseCondition(when)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := condition.String(); got != when {
+		t.Errorf("String() = %q, want %q", got, when)
+	}
+}
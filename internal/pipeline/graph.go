@@ -0,0 +1,168 @@
+package pipeline
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	stepIDPattern  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	stepRefPattern = regexp.MustCompile(`\$\{steps\.([^.}]*)\.output\}`)
+)
+
+// ReplaceStepRefs replaces the ${steps.<id>.output} references in s with the result of
+// output for the step ID
+func ReplaceStepRefs(s string, output func(id string) string) string {
+	return stepRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		return output(stepRefPattern.FindStringSubmatch(ref)[1])
+	})
+}
+
+// StepRefs returns the IDs of the steps whose outputs s references as ${steps.<id>.output}
+func StepRefs(s string) []string {
+	var ids []string
+	for _, match := range stepRefPattern.FindAllStringSubmatch(s, -1) {
+		ids = append(ids, match[1])
+	}
+	return ids
+}
+
+// paramStepRefs returns the IDs of the steps whose outputs a param value references,
+// including in the strings of lists and maps
+func paramStepRefs(value interface{}) []string {
+	var ids []string
+	switch v := value.(type) {
+	case string:
+		ids = StepRefs(v)
+	case map[string]interface{}:
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			ids = append(ids, paramStepRefs(v[key])...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			ids = append(ids, paramStepRefs(item)...)
+		}
+	}
+	return ids
+}
+
+// ReferencedSteps returns the IDs of the steps whose outputs the step references in its
+// input, output or params
+func (s Step) ReferencedSteps() []string {
+	return slices.Concat(StepRefs(s.Input), StepRefs(s.Output), paramStepRefs(s.Params))
+}
+
+// Dependencies returns, for each step, the indexes of the steps it depends on, in
+// ascending order. A step depends on the steps listed in its depends_on and the steps
+// whose outputs it references. If no step declares depends_on, each step also depends
+// on the one before it, so that pipelines without dependencies run in order.
+func (p *Pipeline) Dependencies() ([][]int, error) {
+	index := make(map[string]int)
+	sequential := true
+	for i, step := range p.Steps {
+		if step.DependsOn != nil {
+			sequential = false
+		}
+		if step.ID == "" {
+			continue
+		}
+		if !stepIDPattern.MatchString(step.ID) {
+			return nil, FieldError{Path: fmt.Sprintf("steps[%d].id", i), Message: fmt.Sprintf("invalid id %q: use letters, digits, '_' and '-'", step.ID)}
+		}
+		if j, ok := index[step.ID]; ok {
+			return nil, FieldError{Path: fmt.Sprintf("steps[%d].id", i), Message: fmt.Sprintf("%q is already used by steps[%d]", step.ID, j)}
+		}
+		index[step.ID] = i
+	}
+
+	deps := make([][]int, len(p.Steps))
+	for i, step := range p.Steps {
+		if sequential && i > 0 {
+			deps[i] = append(deps[i], i-1)
+		}
+
+		refs := map[string][]string{
+			"depends_on": step.DependsOn,
+			"input":      StepRefs(step.Input),
+			"output":     StepRefs(step.Output),
+			"params":     paramStepRefs(step.Params),
+		}
+		for _, field := range []string{"depends_on", "input", "output", "params"} {
+			for _, id := range refs[field] {
+				path := fmt.Sprintf("steps[%d].%s", i, field)
+				j, ok := index[id]
+				if !ok {
+					return nil, FieldError{Path: path, Message: fmt.Sprintf("unknown step %q", id)}
+				}
+				if j == i {
+					return nil, FieldError{Path: path, Message: "step depends on itself"}
+				}
+				deps[i] = append(deps[i], j)
+			}
+		}
+
+		slices.Sort(deps[i])
+		deps[i] = slices.Compact(deps[i])
+	}
+
+	if cycle := findCycle(deps); cycle != nil {
+		names := make([]string, len(cycle))
+		for k, i := range cycle {
+			names[k] = p.stepName(i)
+		}
+		return nil, FieldError{Path: "steps", Message: fmt.Sprintf("dependency cycle: %s", strings.Join(names, " -> "))}
+	}
+	return deps, nil
+}
+
+// stepName names a step in errors by its ID, or its index if it has none
+func (p *Pipeline) stepName(i int) string {
+	if id := p.Steps[i].ID; id != "" {
+		return id
+	}
+	return fmt.Sprintf("steps[%d]", i)
+}
+
+// findCycle returns the steps on a dependency cycle, starting and ending with the same
+// step, or nil if the dependencies form a DAG
+func findCycle(deps [][]int) []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(deps))
+	var path []int
+
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		state[i] = visiting
+		path = append(path, i)
+		for _, j := range deps[i] {
+			switch state[j] {
+			case visiting:
+				start := slices.Index(path, j)
+				return append(slices.Clone(path[start:]), j)
+			case unvisited:
+				if cycle := visit(j); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range deps {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDependencies(t *testing.T) {
+	step := func(id string, dependsOn []string, input string, params map[string]interface{}) Step {
+		return Step{ID: id, DependsOn: dependsOn, Operation: "test_encode", Input: input, Output: "${output}/" + id, Params: params}
+	}
+
+	tests := []struct {
+		name  string
+		steps []Step
+		want  [][]int
+	}{
+		{
+			name:  "sequential without depends_on",
+			steps: []Step{step("a", nil, "${input}", nil), step("b", nil, "${input}", nil), step("c", nil, "${input}", nil)},
+			want:  [][]int{nil, {0}, {1}},
+		},
+		{
+			name:  "independent",
+			steps: []Step{step("a", []string{}, "${input}", nil), step("b", []string{}, "${input}", nil)},
+			want:  [][]int{nil, nil},
+		},
+		{
+			name: "references in inputs and params",
+			steps: []Step{
+				step("a", []string{}, "${input}", nil),
+				step("b", []string{}, "${input}", nil),
+				step("c", []string{}, "${steps.a.output}", map[string]interface{}{
+					"overlay": []interface{}{map[string]interface{}{"file": "${steps.b.output}"}},
+				}),
+			},
+			want: [][]int{nil, nil, {0, 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		p := &Pipeline{Name: "graph", Steps: tt.steps}
+		got, err := p.Dependencies()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDependenciesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []Step
+		want  string
+	}{
+		{
+			name:  "unknown step in params",
+			steps: []Step{{ID: "a", DependsOn: []string{}, Params: map[string]interface{}{"file": "${steps.x.output}"}}},
+			want:  `steps[0].params: unknown step "x"`,
+		},
+		{
+			name:  "self reference in params",
+			steps: []Step{{ID: "a", DependsOn: []string{}, Params: map[string]interface{}{"file": "${steps.a.output}"}}},
+			want:  `steps[0].params: step depends on itself`,
+		},
+		{
+			name: "cycle through params",
+			steps: []Step{
+				{ID: "a", DependsOn: []string{"b"}},
+				{ID: "b", DependsOn: []string{}, Params: map[string]interface{}{"file": "${steps.a.output}"}},
+			},
+			want: `steps: dependency cycle: a -> b -> a`,
+		},
+	}
+
+	for _, tt := range tests {
+		p := &Pipeline{Name: "graph", Steps: tt.steps}
+		_, err := p.Dependencies()
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestReferencedSteps(t *testing.T) {
+	s := Step{
+		Input:  "${steps.a.output}",
+		Output: "${output}/x-${steps.b.output}",
+		Params: map[string]interface{}{"files": []interface{}{"${steps.c.output}", 1}},
+	}
+	if got, want := s.ReferencedSteps(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReferencedSteps() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package pipeline
+
+// JSONSchema returns a JSON Schema (draft 2020-12) of pipeline documents, for editors and
+// clients to check pipelines before submitting them. Validate remains the authority: the
+// schema can't express checks such as dependency cycles or parameter references.
+func JSONSchema() map[string]interface{} {
+	defs := map[string]interface{}{
+		"reference": map[string]interface{}{
+			"description": "A reference such as ${params.quality}, substituted when the job runs",
+			"type":        "string",
+			"pattern":     `^\$\{[^}]+\}$`,
+		},
+		"duration": map[string]interface{}{
+			"description": "A duration such as 30s or 10m",
+			"type":        "string",
+			"pattern":     `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`,
+		},
+		"parameter": map[string]interface{}{
+			"type":                 "object",
+			"required":             []string{"type"},
+			"additionalProperties": false,
+			"properties": map[string]interface{}{
+				"type":        map[string]interface{}{"enum": []string{ParamTypeString, ParamTypeInteger, ParamTypeNumber, ParamTypeBoolean}},
+				"default":     map[string]interface{}{"type": []string{"string", "number", "boolean"}},
+				"description": map[string]interface{}{"type": "string"},
+			},
+		},
+		"step": stepSchema(),
+	}
+	for _, name := range OperationNames() {
+		op, _ := LookupOperation(name)
+		defs["params_"+name] = operationParamsSchema(op.Schema())
+	}
+
+	return map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"$id":                  "/schemas/pipeline.json",
+		"title":                "Pipeline",
+		"type":                 "object",
+		"required":             []string{"name", "steps"},
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"name":        map[string]interface{}{"type": "string", "minLength": 1},
+			"description": map[string]interface{}{"type": "string"},
+			"steps": map[string]interface{}{
+				"type":     "array",
+				"minItems": 1,
+				"items":    map[string]interface{}{"$ref": "#/$defs/step"},
+			},
+			"retry": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": false,
+				"properties": map[string]interface{}{
+					"max_attempts": map[string]interface{}{"type": "integer", "minimum": 0},
+					"backoff":      map[string]interface{}{"$ref": "#/$defs/duration"},
+					"max_backoff":  map[string]interface{}{"$ref": "#/$defs/duration"},
+					"jitter":       map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1},
+				},
+			},
+			"parameters": map[string]interface{}{
+				"type":                 "object",
+				"propertyNames":        map[string]interface{}{"pattern": paramNamePattern.String()},
+				"additionalProperties": map[string]interface{}{"$ref": "#/$defs/parameter"},
+			},
+			"max_parallel": map[string]interface{}{"type": "integer", "minimum": 0},
+			"deadline":     map[string]interface{}{"$ref": "#/$defs/duration"},
+			"requires": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"type": "string", "pattern": `^[^,\s]+$`},
+			},
+		},
+		"$defs": defs,
+	}
+}
+
+// stepSchema describes a step, choosing the params schema by the step's operation
+func stepSchema() map[string]interface{} {
+	names := OperationNames()
+	var byOperation []interface{}
+	for _, name := range names {
+		byOperation = append(byOperation, map[string]interface{}{
+			"if": map[string]interface{}{
+				"properties": map[string]interface{}{"operation": map[string]interface{}{"const": name}},
+			},
+			"then": map[string]interface{}{
+				"properties": map[string]interface{}{"params": map[string]interface{}{"$ref": "#/$defs/params_" + name}},
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"required":             []string{"operation", "input", "output"},
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"id":         map[string]interface{}{"type": "string", "pattern": stepIDPattern.String()},
+			"depends_on": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"operation":  map[string]interface{}{"enum": names},
+			"input":      map[string]interface{}{"type": "string", "minLength": 1},
+			"output":     map[string]interface{}{"type": "string", "minLength": 1},
+			"params":     map[string]interface{}{"type": "object"},
+			"when":       map[string]interface{}{"type": "string"},
+			"timeout":    map[string]interface{}{"$ref": "#/$defs/duration"},
+			"max_memory": map[string]interface{}{"type": "string", "pattern": `^[0-9]+(\.[0-9]+)?[KkMmGgTt]?[Bb]?$`},
+			"nice":       map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 19},
+			"cpu_weight": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 10000},
+		},
+		"allOf": byOperation,
+	}
+}
+
+// operationParamsSchema describes the params of an operation. Params may also be
+// references, whose values are only known when the job runs.
+func operationParamsSchema(op OperationSchema) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	for name, param := range op.Params {
+		properties[name] = map[string]interface{}{
+			"anyOf": []interface{}{param.jsonSchema(), map[string]interface{}{"$ref": "#/$defs/reference"}},
+		}
+		if param.Required {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"description":          op.Description,
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties":           properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s ParamSchema) jsonSchema() map[string]interface{} {
+	schema := map[string]interface{}{"type": s.Type}
+	if s.Description != "" {
+		schema["description"] = s.Description
+	}
+	if len(s.Enum) > 0 {
+		schema["enum"] = s.Enum
+	}
+	if s.Pattern != "" {
+		schema["pattern"] = s.Pattern
+	}
+	if s.Min != nil {
+		schema["minimum"] = *s.Min
+	}
+	if s.Max != nil {
+		schema["maximum"] = *s.Max
+	}
+	return schema
+}
@@ -0,0 +1,249 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// OperationSchema describes an operation steps can run and the params it accepts
+type OperationSchema struct {
+	Description string
+	Params      map[string]ParamSchema
+}
+
+// ParamSchema describes a param of an operation
+type ParamSchema struct {
+	Type        string // One of the parameter types, e.g. ParamTypeInteger
+	Description string
+	Required    bool
+	Enum        []string // Allowed values of a string
+	Pattern     string   // Regular expression a string must match
+	Min, Max    *float64 // Range of a number
+}
+
+// Operation is an operation steps can run. Operations are registered with
+// RegisterOperation, usually from the init function of the package implementing them, and
+// must also implement CommandOperation or InProcessOperation.
+type Operation interface {
+	// Name is the name steps refer to the operation by, e.g. "transcode"
+	Name() string
+
+	// Schema describes the operation and the params it accepts
+	Schema() OperationSchema
+
+	// Capabilities returns the capabilities a worker needs to run a step, such as the
+	// tools the operation runs
+	Capabilities(step Step) []string
+}
+
+// CommandOperation is an operation that runs an external tool. Steps are passed with their
+// input and output paths resolved and their params substituted.
+type CommandOperation interface {
+	Operation
+	Command(step Step) (*Command, error)
+}
+
+// InProcessOperation is an operation that runs in the worker's process, writing what it
+// does to log. Steps are passed as for CommandOperation.
+type InProcessOperation interface {
+	Operation
+	Run(ctx context.Context, step Step, log io.Writer) error
+}
+
+// Command is an external tool run with arguments
+type Command struct {
+	Tool string
+	Args []string
+}
+
+var (
+	operationsMu sync.RWMutex
+	operations   = map[string]Operation{}
+	// paramPatterns caches compiled param patterns by expression
+	paramPatterns = map[string]*regexp.Regexp{}
+)
+
+// RegisterOperation makes an operation available to steps. It panics if the operation's
+// name is invalid or already registered, if the operation can't be run, or if a param's
+// pattern doesn't compile.
+func RegisterOperation(op Operation) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+
+	name := op.Name()
+	if !paramNamePattern.MatchString(name) {
+		panic(fmt.Sprintf("pipeline: invalid operation name %q", name))
+	}
+	if _, exists := operations[name]; exists {
+		panic(fmt.Sprintf("pipeline: operation %q registered twice", name))
+	}
+	switch op.(type) {
+	case CommandOperation, InProcessOperation:
+	default:
+		panic(fmt.Sprintf("pipeline: operation %q is neither a CommandOperation nor an InProcessOperation", name))
+	}
+
+	patterns := map[string]*regexp.Regexp{}
+	for paramName, param := range op.Schema().Params {
+		if param.Pattern == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(param.Pattern)
+		if err != nil {
+			panic(fmt.Sprintf("pipeline: operation %q has an invalid pattern for param %q: %v", name, paramName, err))
+		}
+		patterns[param.Pattern] = pattern
+	}
+	maps.Copy(paramPatterns, patterns)
+	operations[name] = op
+}
+
+// LookupOperation returns the registered operation with the given name
+func LookupOperation(name string) (Operation, bool) {
+	operationsMu.RLock()
+	defer operationsMu.RUnlock()
+	op, ok := operations[name]
+	return op, ok
+}
+
+// OperationNames returns the names of the registered operations, sorted
+func OperationNames() []string {
+	operationsMu.RLock()
+	defer operationsMu.RUnlock()
+	return slices.Sorted(maps.Keys(operations))
+}
+
+// checkParams checks a step's params against its operation's schema. A param that is
+// just a reference to a pipeline parameter (declared) is checked by the parameter's type;
+// other references can only be checked once substituted.
+func (schema OperationSchema) checkParams(path string, params map[string]interface{}, declared map[string]Parameter) []FieldError {
+	var errs []FieldError
+
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		paramSchema, ok := schema.Params[name]
+		if !ok {
+			message := fmt.Sprintf("unknown param %q", name)
+			if len(schema.Params) > 0 {
+				message += fmt.Sprintf(" (supported: %s)", strings.Join(slices.Sorted(maps.Keys(schema.Params)), ", "))
+			} else {
+				message += " (the operation takes no params)"
+			}
+			errs = append(errs, FieldError{Path: path + "." + name, Message: message})
+			continue
+		}
+		if message := paramSchema.check(params[name], declared); message != "" {
+			errs = append(errs, FieldError{Path: path + "." + name, Message: message})
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(schema.Params)) {
+		if _, ok := params[name]; !ok && schema.Params[name].Required {
+			errs = append(errs, FieldError{Path: path + "." + name, Message: "required"})
+		}
+	}
+	return errs
+}
+
+// check returns what is wrong with a param value, or "" if it is valid
+func (s ParamSchema) check(value interface{}, declared map[string]Parameter) string {
+	if str, ok := value.(string); ok && strings.Contains(str, "${") {
+		if match := varRefPattern.FindStringSubmatch(str); match != nil && match[0] == str {
+			name, isParam := strings.CutPrefix(match[1], "params.")
+			param, isDeclared := declared[name]
+			if isParam && isDeclared && !paramTypeFits(param.Type, s.Type) {
+				return fmt.Sprintf("parameter %q is a %s, expected %s", name, param.Type, withArticle(s.Type))
+			}
+			return ""
+		}
+		if s.Type == ParamTypeString {
+			return "" // Checked once substituted
+		}
+	}
+
+	switch s.Type {
+	case ParamTypeString:
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Sprintf("expected a string, got %v", value)
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			return fmt.Sprintf("must be one of %s, got %q", strings.Join(s.Enum, ", "), str)
+		}
+		if s.Pattern != "" {
+			pattern, err := paramPattern(s.Pattern)
+			if err != nil {
+				return fmt.Sprintf("can't be checked: %v", err)
+			}
+			if !pattern.MatchString(str) {
+				return fmt.Sprintf("invalid value %q", str)
+			}
+		}
+
+	case ParamTypeInteger, ParamTypeNumber:
+		var n float64
+		switch v := value.(type) {
+		case int:
+			n = float64(v)
+		case int64:
+			n = float64(v)
+		case float64:
+			n = v
+		default:
+			return fmt.Sprintf("expected %s, got %v", withArticle(s.Type), value)
+		}
+		if s.Type == ParamTypeInteger && n != float64(int64(n)) {
+			return fmt.Sprintf("expected an integer, got %v", value)
+		}
+		if s.Min != nil && n < *s.Min {
+			return fmt.Sprintf("must be at least %v, got %v", *s.Min, value)
+		}
+		if s.Max != nil && n > *s.Max {
+			return fmt.Sprintf("must be at most %v, got %v", *s.Max, value)
+		}
+
+	case ParamTypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Sprintf("expected a boolean, got %v", value)
+		}
+	}
+	return ""
+}
+
+// paramPattern returns a compiled param pattern. The patterns of registered operations are
+// compiled when they are registered; others are compiled on first use.
+func paramPattern(expr string) (*regexp.Regexp, error) {
+	operationsMu.RLock()
+	pattern, ok := paramPatterns[expr]
+	operationsMu.RUnlock()
+	if ok {
+		return pattern, nil
+	}
+
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", expr, err)
+	}
+	operationsMu.Lock()
+	paramPatterns[expr] = pattern
+	operationsMu.Unlock()
+	return pattern, nil
+}
+
+// paramTypeFits reports whether values of a pipeline parameter type are valid for a param
+// of the given type
+func paramTypeFits(paramType, want string) bool {
+	return paramType == want || (paramType == ParamTypeInteger && want == ParamTypeNumber)
+}
+
+func withArticle(paramType string) string {
+	if paramType == ParamTypeInteger {
+		return "an integer"
+	}
+	return "a " + paramType
+}
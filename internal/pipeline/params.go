@@ -0,0 +1,264 @@
+package pipeline
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// Parameter types
+const (
+	ParamTypeString  = "string"
+	ParamTypeInteger = "integer"
+	ParamTypeNumber  = "number"
+	ParamTypeBoolean = "boolean"
+)
+
+// Parameter declares a value jobs may supply when they are submitted, referenced in steps
+// as ${params.<name>}. Parameters without a default are required.
+type Parameter struct {
+	Type        string      `json:"type" yaml:"type"`
+	Default     interface{} `json:"default,omitempty" yaml:"default,omitempty"`
+	Description string      `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+var (
+	paramNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	paramRefPattern  = regexp.MustCompile(`\$\{params\.([^}]*)\}`)
+	varRefPattern    = regexp.MustCompile(`\$\{([^}]+)\}`)
+)
+
+// ParamVariables returns the variables parameter values are substituted as
+func ParamVariables(values map[string]interface{}) map[string]interface{} {
+	vars := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		vars["params."+name] = value
+	}
+	return vars
+}
+
+// ResolveParams checks the values supplied for a job against the declared parameters and
+// returns the values of all parameters: supplied values converted to the parameter's type
+// (strings, such as S3 metadata, are parsed) and the defaults of the others. The steps'
+// params are checked with the values substituted.
+func (p *Pipeline) ResolveParams(values map[string]interface{}) (map[string]interface{}, error) {
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if _, ok := p.Parameters[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+
+	resolved := make(map[string]interface{}, len(p.Parameters))
+	for _, name := range slices.Sorted(maps.Keys(p.Parameters)) {
+		param := p.Parameters[name]
+		value, ok := values[name]
+		if !ok || value == nil {
+			if param.Default == nil {
+				return nil, fmt.Errorf("missing required parameter %q", name)
+			}
+			value = param.Default
+		}
+
+		converted, err := param.convert(value)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q: %w", name, err)
+		}
+		resolved[name] = converted
+	}
+
+	// Values may be of the right type but not valid for the params using them
+	if err := p.checkResolvedParams(resolved); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// convert converts a value to the parameter's type
+func (param Parameter) convert(value interface{}) (interface{}, error) {
+	s, isString := value.(string)
+
+	switch param.Type {
+	case ParamTypeString:
+		if !isString {
+			return nil, fmt.Errorf("expected a string, got %v", value)
+		}
+		return s, nil
+
+	case ParamTypeInteger:
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case int64:
+			return int(v), nil
+		case float64:
+			if v == float64(int(v)) {
+				return int(v), nil
+			}
+		case string:
+			if n, err := strconv.Atoi(v); err == nil {
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("expected an integer, got %v", value)
+
+	case ParamTypeNumber:
+		switch v := value.(type) {
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("expected a number, got %v", value)
+
+	case ParamTypeBoolean:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("expected a boolean, got %v", value)
+
+	default:
+		return nil, fmt.Errorf("invalid type %q", param.Type)
+	}
+}
+
+// validateParams checks the declared parameters and the steps' references to them
+func (p *Pipeline) validateParams() []FieldError {
+	var errs []FieldError
+	for _, name := range slices.Sorted(maps.Keys(p.Parameters)) {
+		param := p.Parameters[name]
+		path := "parameters." + name
+		if !paramNamePattern.MatchString(name) {
+			errs = append(errs, FieldError{Path: path, Message: "invalid name: use letters, digits and '_'"})
+		}
+		switch param.Type {
+		case ParamTypeString, ParamTypeInteger, ParamTypeNumber, ParamTypeBoolean:
+			if param.Default != nil {
+				if _, err := param.convert(param.Default); err != nil {
+					errs = append(errs, FieldError{Path: path + ".default", Message: err.Error()})
+				}
+			}
+		default:
+			errs = append(errs, FieldError{Path: path + ".type", Message: "must be string, integer, number or boolean"})
+		}
+	}
+
+	for i, step := range p.Steps {
+		fields := []struct {
+			name  string
+			value interface{}
+		}{{"input", step.Input}, {"output", step.Output}, {"params", step.Params}}
+		for _, field := range fields {
+			for _, name := range paramRefs(field.value) {
+				if _, ok := p.Parameters[name]; !ok {
+					errs = append(errs, FieldError{Path: fmt.Sprintf("steps[%d].%s", i, field.name), Message: fmt.Sprintf("unknown parameter %q", name)})
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkResolvedParams checks the steps' params with the parameter values of a job
+// substituted against their operations' schemas
+func (p *Pipeline) checkResolvedParams(values map[string]interface{}) error {
+	vars := ParamVariables(values)
+	var errs []FieldError
+	for i, step := range p.Steps {
+		if op, ok := LookupOperation(step.Operation); ok {
+			params := SubstituteParams(step.Params, vars)
+			errs = append(errs, op.Schema().checkParams(fmt.Sprintf("steps[%d].params", i), params, p.Parameters)...)
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// paramRefs returns the names of the parameters a step value references
+func paramRefs(value interface{}) []string {
+	var names []string
+	switch v := value.(type) {
+	case string:
+		for _, match := range paramRefPattern.FindAllStringSubmatch(v, -1) {
+			names = append(names, match[1])
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			names = append(names, paramRefs(item)...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			names = append(names, paramRefs(item)...)
+		}
+	}
+	return names
+}
+
+// Substitute replaces the ${name} references to the given variables in s. References to
+// other variables are left as they are.
+func Substitute(s string, vars map[string]interface{}) string {
+	return varRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		value, ok := vars[ref[2:len(ref)-1]]
+		if !ok {
+			return ref
+		}
+		return formatVar(value)
+	})
+}
+
+// SubstituteParams substitutes variables in the strings of a step's params, including
+// the strings in lists and maps. A string that is just a reference takes the variable's
+// value and type, so that "${params.crf}" can stand for a number.
+func SubstituteParams(params map[string]interface{}, vars map[string]interface{}) map[string]interface{} {
+	if params == nil {
+		return nil
+	}
+	substituted := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		substituted[key] = substituteValue(value, vars)
+	}
+	return substituted
+}
+
+func substituteValue(value interface{}, vars map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if match := varRefPattern.FindStringSubmatchIndex(v); match != nil && match[0] == 0 && match[1] == len(v) {
+			if typed, ok := vars[v[2:len(v)-1]]; ok {
+				return typed
+			}
+		}
+		return Substitute(v, vars)
+	case map[string]interface{}:
+		return SubstituteParams(v, vars)
+	case []interface{}:
+		substituted := make([]interface{}, len(v))
+		for i, item := range v {
+			substituted[i] = substituteValue(item, vars)
+		}
+		return substituted
+	default:
+		return value
+	}
+}
+
+func formatVar(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
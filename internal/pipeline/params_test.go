@@ -0,0 +1,284 @@
+package pipeline
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testEncode is an operation for testing params against a schema
+type testEncode struct{}
+
+func (testEncode) Name() string { return "test_encode" }
+
+func (testEncode) Schema() OperationSchema {
+	minQuality, maxQuality := 1.0, 51.0
+	return OperationSchema{
+		Params: map[string]ParamSchema{
+			"codec":   {Type: ParamTypeString, Pattern: `^[a-z0-9]+$`},
+			"preset":  {Type: ParamTypeString, Enum: []string{"fast", "slow"}},
+			"quality": {Type: ParamTypeInteger, Min: &minQuality, Max: &maxQuality},
+			"rate":    {Type: ParamTypeNumber},
+			"twopass": {Type: ParamTypeBoolean},
+		},
+	}
+}
+
+func (testEncode) Capabilities(Step) []string { return nil }
+
+func (testEncode) Command(step Step) (*Command, error) {
+	return &Command{Tool: "true"}, nil
+}
+
+func init() {
+	RegisterOperation(testEncode{})
+}
+
+// encodePipeline returns a pipeline whose only step passes the parameters to test_encode
+func encodePipeline(parameters map[string]Parameter, params map[string]interface{}) *Pipeline {
+	return &Pipeline{
+		Name:       "encode",
+		Parameters: parameters,
+		Steps: []Step{{
+			Operation: "test_encode",
+			Input:     "${input}",
+			Output:    "${output}/out.mp4",
+			Params:    params,
+		}},
+	}
+}
+
+func TestResolveParams(t *testing.T) {
+	p := encodePipeline(map[string]Parameter{
+		"codec":   {Type: ParamTypeString, Default: "h264"},
+		"crf":     {Type: ParamTypeInteger, Default: 23},
+		"rate":    {Type: ParamTypeNumber, Default: 1.0},
+		"twopass": {Type: ParamTypeBoolean, Default: false},
+		"label":   {Type: ParamTypeString},
+	}, map[string]interface{}{
+		"codec":   "${params.codec}",
+		"quality": "${params.crf}",
+		"rate":    "${params.rate}",
+		"twopass": "${params.twopass}",
+	})
+
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{
+			name:   "defaults",
+			values: map[string]interface{}{"label": "x"},
+			want:   map[string]interface{}{"codec": "h264", "crf": 23, "rate": 1.0, "twopass": false, "label": "x"},
+		},
+		{
+			name:   "JSON values",
+			values: map[string]interface{}{"label": "x", "crf": 30.0, "rate": 2, "twopass": true},
+			want:   map[string]interface{}{"codec": "h264", "crf": 30, "rate": 2.0, "twopass": true, "label": "x"},
+		},
+		{
+			name:   "strings are parsed",
+			values: map[string]interface{}{"label": "x", "crf": "18", "rate": "0.5", "twopass": "true"},
+			want:   map[string]interface{}{"codec": "h264", "crf": 18, "rate": 0.5, "twopass": true, "label": "x"},
+		},
+		{
+			name:   "null takes the default",
+			values: map[string]interface{}{"label": "x", "crf": nil},
+			want:   map[string]interface{}{"codec": "h264", "crf": 23, "rate": 1.0, "twopass": false, "label": "x"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := p.ResolveParams(tt.values)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveParamsErrors(t *testing.T) {
+	p := encodePipeline(map[string]Parameter{
+		"codec":  {Type: ParamTypeString, Default: "h264"},
+		"crf":    {Type: ParamTypeInteger, Default: 23},
+		"preset": {Type: ParamTypeString, Default: "fast"},
+		"label":  {Type: ParamTypeString},
+	}, map[string]interface{}{
+		"codec":   "${params.codec}",
+		"quality": "${params.crf}",
+		"preset":  "${params.preset}",
+	})
+
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		want   string
+	}{
+		{"unknown", map[string]interface{}{"label": "x", "bitrate": 1}, `unknown parameter "bitrate"`},
+		{"missing", map[string]interface{}{}, `missing required parameter "label"`},
+		{"fraction", map[string]interface{}{"label": "x", "crf": 1.5}, `parameter "crf": expected an integer, got 1.5`},
+		{"unparsable", map[string]interface{}{"label": "x", "crf": "high"}, `parameter "crf": expected an integer, got high`},
+		{"not a string", map[string]interface{}{"label": 5}, `parameter "label": expected a string, got 5`},
+		{"pattern", map[string]interface{}{"label": "x", "codec": "H 264"}, `steps[0].params.codec: invalid value "H 264"`},
+		{"enum", map[string]interface{}{"label": "x", "preset": "medium"}, `steps[0].params.preset: must be one of fast, slow, got "medium"`},
+		{"minimum", map[string]interface{}{"label": "x", "crf": 0}, `steps[0].params.quality: must be at least 1, got 0`},
+		{"maximum", map[string]interface{}{"label": "x", "crf": "52"}, `steps[0].params.quality: must be at most 51, got 52`},
+	}
+
+	for _, tt := range tests {
+		_, err := p.ResolveParams(tt.values)
+		if err == nil {
+			t.Errorf("%s: succeeded, want error %q", tt.name, tt.want)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("%s: error = %q, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParameterConvert(t *testing.T) {
+	tests := []struct {
+		typ     string
+		value   interface{}
+		want    interface{}
+		wantErr string
+	}{
+		{ParamTypeString, "abc", "abc", ""},
+		{ParamTypeString, 1, nil, "expected a string, got 1"},
+		{ParamTypeString, true, nil, "expected a string, got true"},
+
+		{ParamTypeInteger, 3, 3, ""},
+		{ParamTypeInteger, int64(3), 3, ""},
+		{ParamTypeInteger, 3.0, 3, ""},
+		{ParamTypeInteger, "-7", -7, ""},
+		{ParamTypeInteger, 3.5, nil, "expected an integer, got 3.5"},
+		{ParamTypeInteger, "3.5", nil, "expected an integer, got 3.5"},
+		{ParamTypeInteger, true, nil, "expected an integer, got true"},
+
+		{ParamTypeNumber, 3, 3.0, ""},
+		{ParamTypeNumber, int64(3), 3.0, ""},
+		{ParamTypeNumber, 2.5, 2.5, ""},
+		{ParamTypeNumber, "1e3", 1000.0, ""},
+		{ParamTypeNumber, "fast", nil, "expected a number, got fast"},
+
+		{ParamTypeBoolean, true, true, ""},
+		{ParamTypeBoolean, "false", false, ""},
+		{ParamTypeBoolean, "1", true, ""},
+		{ParamTypeBoolean, "yes", nil, "expected a boolean, got yes"},
+		{ParamTypeBoolean, 1, nil, "expected a boolean, got 1"},
+
+		{"date", "2025-01-01", nil, `invalid type "date"`},
+	}
+
+	for _, tt := range tests {
+		got, err := Parameter{Type: tt.typ}.convert(tt.value)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("convert %s %#v: error = %v, want %q", tt.typ, tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("convert %s %#v: %v", tt.typ, tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("convert %s %#v = %#v, want %#v", tt.typ, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSubstituteParams(t *testing.T) {
+	vars := map[string]interface{}{
+		"params.crf":   23,
+		"params.rate":  0.5,
+		"params.big":   1e6,
+		"params.codec": "h264",
+		"params.fast":  true,
+		"basename":     "clip",
+	}
+
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{
+			name:   "a reference keeps the type",
+			params: map[string]interface{}{"quality": "${params.crf}", "rate": "${params.rate}", "fast": "${params.fast}"},
+			want:   map[string]interface{}{"quality": 23, "rate": 0.5, "fast": true},
+		},
+		{
+			name:   "references in strings are formatted",
+			params: map[string]interface{}{"title": "${basename} at crf ${params.crf}", "rate": "x${params.rate}", "big": "${params.big}b"},
+			want:   map[string]interface{}{"title": "clip at crf 23", "rate": "x0.5", "big": "1000000b"},
+		},
+		{
+			name:   "lists and maps",
+			params: map[string]interface{}{"args": []interface{}{"-c", "${params.codec}", 2}, "meta": map[string]interface{}{"crf": "${params.crf}"}},
+			want:   map[string]interface{}{"args": []interface{}{"-c", "h264", 2}, "meta": map[string]interface{}{"crf": 23}},
+		},
+		{
+			name:   "other references are left alone",
+			params: map[string]interface{}{"in": "${steps.a.output}", "unknown": "${params.nope}", "n": 5},
+			want:   map[string]interface{}{"in": "${steps.a.output}", "unknown": "${params.nope}", "n": 5},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := SubstituteParams(tt.params, vars); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := SubstituteParams(nil, vars); got != nil {
+		t.Errorf("SubstituteParams(nil) = %#v, want nil", got)
+	}
+}
+
+func TestParamSchemaPattern(t *testing.T) {
+	tests := []struct {
+		schema ParamSchema
+		value  interface{}
+		want   string
+	}{
+		{ParamSchema{Type: ParamTypeString, Pattern: `^[0-9]+k$`}, "128k", ""},
+		{ParamSchema{Type: ParamTypeString, Pattern: `^[0-9]+k$`}, "128", `invalid value "128"`},
+		{ParamSchema{Type: ParamTypeString, Pattern: `^[0-9]+k$`}, "${params.bitrate}", ""}, // Checked once substituted
+		{ParamSchema{Type: ParamTypeString, Pattern: `^[0-9]+k$`}, 128, "expected a string, got 128"},
+		{ParamSchema{Type: ParamTypeString, Pattern: `(`}, "x", "can't be checked: invalid pattern \"(\": error parsing regexp: missing closing ): `(`"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.schema.check(tt.value, nil); got != tt.want {
+			t.Errorf("pattern %q, value %#v: got %q, want %q", tt.schema.Pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+// badPatternOperation declares a param whose pattern doesn't compile
+type badPatternOperation struct{ testEncode }
+
+func (badPatternOperation) Name() string { return "test_bad_pattern" }
+
+func (badPatternOperation) Schema() OperationSchema {
+	return OperationSchema{Params: map[string]ParamSchema{"size": {Type: ParamTypeString, Pattern: `[0-9`}}}
+}
+
+func TestRegisterOperationInvalidPattern(t *testing.T) {
+	defer func() {
+		message, _ := recover().(string)
+		if !strings.Contains(message, `invalid pattern for param "size"`) {
+			t.Errorf("RegisterOperation panicked with %q, want an invalid pattern error", message)
+		}
+		if _, ok := LookupOperation("test_bad_pattern"); ok {
+			t.Error("operation with an invalid pattern was registered")
+		}
+	}()
+	RegisterOperation(badPatternOperation{})
+}
@@ -2,23 +2,63 @@ package pipeline
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Pipeline represents a processing pipeline
 type Pipeline struct {
-	Name  string `json:"name" yaml:"name"`
-	Steps []Step `json:"steps" yaml:"steps"`
+	Name        string       `json:"name" yaml:"name"`
+	Description string       `json:"description,omitempty" yaml:"description,omitempty"`
+	Steps       []Step       `json:"steps" yaml:"steps"`
+	Retry       *RetryPolicy `json:"retry,omitempty" yaml:"retry,omitempty"`
+
+	// Values jobs supply when they are submitted, by name
+	Parameters map[string]Parameter `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+
+	// How many independent steps may run at once, capped by the worker's limit
+	MaxParallel int `json:"max_parallel,omitempty" yaml:"max_parallel,omitempty"`
+
+	// How long jobs using the pipeline stay useful once they may run, e.g. "30m". Jobs
+	// still waiting after that expire, and running ones are cancelled.
+	Deadline string `json:"deadline,omitempty" yaml:"deadline,omitempty"`
+
+	// Capabilities a worker needs on top of the ones the steps' operations imply,
+	// e.g. "encoder:h264_nvenc"
+	Requires []string `json:"requires,omitempty" yaml:"requires,omitempty"`
 }
 
 // Step represents a single processing step
 type Step struct {
+	// ID names the step for depends_on and ${steps.<id>.output} references
+	ID        string                 `json:"id,omitempty" yaml:"id,omitempty"`
+	DependsOn []string               `json:"depends_on,omitempty" yaml:"depends_on,omitempty"`
 	Operation string                 `json:"operation" yaml:"operation"`
 	Input     string                 `json:"input" yaml:"input"`
 	Output    string                 `json:"output" yaml:"output"`
 	Params    map[string]interface{} `json:"params,omitempty" yaml:"params,omitempty"`
+
+	// Condition on the input the step runs under, e.g. "width > 1920"; see Condition
+	When string `json:"when,omitempty" yaml:"when,omitempty"`
+
+	// Resource limits for the step's tool; unset values fall back to the worker defaults
+	Timeout   string `json:"timeout,omitempty" yaml:"timeout,omitempty"`       // e.g. "30m"
+	MaxMemory string `json:"max_memory,omitempty" yaml:"max_memory,omitempty"` // e.g. "2G"
+	Nice      *int   `json:"nice,omitempty" yaml:"nice,omitempty"`             // 0 (normal) to 19 (lowest CPU priority)
+	CPUWeight int    `json:"cpu_weight,omitempty" yaml:"cpu_weight,omitempty"` // cgroup v2 cpu.weight, 1-10000
+}
+
+// RetryPolicy overrides the global retry settings for jobs using the pipeline
+type RetryPolicy struct {
+	MaxAttempts int      `json:"max_attempts,omitempty" yaml:"max_attempts,omitempty"`
+	Backoff     string   `json:"backoff,omitempty" yaml:"backoff,omitempty"`         // e.g. "30s"
+	MaxBackoff  string   `json:"max_backoff,omitempty" yaml:"max_backoff,omitempty"` // e.g. "10m"
+	Jitter      *float64 `json:"jitter,omitempty" yaml:"jitter,omitempty"`           // Fraction between 0 and 1
 }
 
 // ParseYAML parses a YAML pipeline definition
@@ -49,24 +89,159 @@ func (p *Pipeline) ToJSON() ([]byte, error) {
 	return json.Marshal(p)
 }
 
-// Validate performs basic validation on the pipeline
+// FieldError is a problem with a field of a pipeline definition, such as
+// steps[2].params.codec
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationError lists the problems found in a pipeline definition
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate checks the pipeline definition, including each step's params against its
+// operation's schema. All problems found are returned as a *ValidationError.
 func (p *Pipeline) Validate() error {
+	var errs []FieldError
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
 	if p.Name == "" {
-		return fmt.Errorf("pipeline name is required")
+		add("name", "required")
 	}
 	if len(p.Steps) == 0 {
-		return fmt.Errorf("pipeline must have at least one step")
+		add("steps", "at least one step is required")
 	}
 	for i, step := range p.Steps {
-		if step.Operation == "" {
-			return fmt.Errorf("step %d: operation is required", i)
+		path := fmt.Sprintf("steps[%d]", i)
+		op, known := LookupOperation(step.Operation)
+		switch {
+		case step.Operation == "":
+			add(path+".operation", "required")
+		case !known:
+			add(path+".operation", "unknown operation %q (supported: %s)", step.Operation, strings.Join(OperationNames(), ", "))
+		default:
+			errs = append(errs, op.Schema().checkParams(path+".params", step.Params, p.Parameters)...)
 		}
 		if step.Input == "" {
-			return fmt.Errorf("step %d: input is required", i)
+			add(path+".input", "required")
 		}
 		if step.Output == "" {
-			return fmt.Errorf("step %d: output is required", i)
+			add(path+".output", "required")
+		}
+		errs = append(errs, step.validateLimits(path)...)
+		if step.When != "" {
+			if _, err := ParseCondition(step.When); err != nil {
+				add(path+".when", "%v", err)
+			}
 		}
 	}
+	if _, err := p.Dependencies(); err != nil {
+		var fieldErr FieldError
+		if errors.As(err, &fieldErr) {
+			errs = append(errs, fieldErr)
+		} else {
+			add("steps", "%v", err)
+		}
+	}
+	errs = append(errs, p.validateParams()...)
+	if p.MaxParallel < 0 {
+		add("max_parallel", "must not be negative")
+	}
+	if p.Deadline != "" {
+		if d, err := time.ParseDuration(p.Deadline); err != nil || d <= 0 {
+			add("deadline", "invalid duration %q", p.Deadline)
+		}
+	}
+	if p.Retry != nil {
+		errs = append(errs, p.Retry.validate()...)
+	}
+	for i, capability := range p.Requires {
+		if capability == "" || strings.ContainsAny(capability, ", \t") {
+			add(fmt.Sprintf("requires[%d]", i), "invalid capability %q", capability)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
 	return nil
 }
+
+func (s *Step) validateLimits(path string) []FieldError {
+	var errs []FieldError
+	if s.Timeout != "" {
+		if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+			errs = append(errs, FieldError{Path: path + ".timeout", Message: fmt.Sprintf("invalid duration %q", s.Timeout)})
+		}
+	}
+	if s.MaxMemory != "" {
+		if _, err := ParseByteSize(s.MaxMemory); err != nil {
+			errs = append(errs, FieldError{Path: path + ".max_memory", Message: err.Error()})
+		}
+	}
+	if s.Nice != nil && (*s.Nice < 0 || *s.Nice > 19) {
+		errs = append(errs, FieldError{Path: path + ".nice", Message: "must be between 0 and 19"})
+	}
+	if s.CPUWeight != 0 && (s.CPUWeight < 1 || s.CPUWeight > 10000) {
+		errs = append(errs, FieldError{Path: path + ".cpu_weight", Message: "must be between 1 and 10000"})
+	}
+	return errs
+}
+
+// ParseByteSize parses a size such as "512M", "2G" or "1048576" into bytes
+func ParseByteSize(s string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+	multiplier := int64(1)
+	if n := len(str); n > 0 {
+		if m, ok := units[str[n-1]]; ok {
+			multiplier = m
+			str = str[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+func (r *RetryPolicy) validate() []FieldError {
+	var errs []FieldError
+	if r.MaxAttempts < 0 {
+		errs = append(errs, FieldError{Path: "retry.max_attempts", Message: "must not be negative"})
+	}
+	if r.Backoff != "" {
+		if _, err := time.ParseDuration(r.Backoff); err != nil {
+			errs = append(errs, FieldError{Path: "retry.backoff", Message: fmt.Sprintf("invalid duration %q", r.Backoff)})
+		}
+	}
+	if r.MaxBackoff != "" {
+		if _, err := time.ParseDuration(r.MaxBackoff); err != nil {
+			errs = append(errs, FieldError{Path: "retry.max_backoff", Message: fmt.Sprintf("invalid duration %q", r.MaxBackoff)})
+		}
+	}
+	if r.Jitter != nil && (*r.Jitter < 0 || *r.Jitter > 1) {
+		errs = append(errs, FieldError{Path: "retry.jitter", Message: "must be between 0 and 1"})
+	}
+	return errs
+}
@@ -3,10 +3,15 @@ package s3compat
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,23 +19,24 @@ import (
 	"github.com/minio/minio-go/v7"
 	"github.com/mukund/mediaconvert/internal/config"
 	"github.com/mukund/mediaconvert/internal/models"
+	"github.com/mukund/mediaconvert/internal/pipeline"
 	"github.com/mukund/mediaconvert/internal/worker"
 	"gorm.io/gorm"
 )
 
 type S3Handler struct {
-	db           *gorm.DB
-	minioClient  *minio.Client
-	config       *config.Config
-	redis        *worker.RedisClient
+	db          *gorm.DB
+	minioClient *minio.Client
+	config      *config.Config
+	queue       worker.Queue
 }
 
-func NewS3Handler(db *gorm.DB, minioClient *minio.Client, cfg *config.Config, redis *worker.RedisClient) *S3Handler {
+func NewS3Handler(db *gorm.DB, minioClient *minio.Client, cfg *config.Config, queue worker.Queue) *S3Handler {
 	return &S3Handler{
 		db:          db,
 		minioClient: minioClient,
 		config:      cfg,
-		redis:       redis,
+		queue:       queue,
 	}
 }
 
@@ -53,9 +59,125 @@ func (h *S3Handler) PutObject(c *gin.Context) {
 		return
 	}
 
+	// Parse job routing metadata up front so a bad value is rejected before uploading
+	priority := 0
+	if v := c.GetHeader("X-Amz-Meta-Priority"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid priority: " + v})
+			return
+		}
+		priority = p
+	}
+	queue := c.GetHeader("X-Amz-Meta-Queue")
+	if queue == "" {
+		queue = models.DefaultJobQueue
+	}
+	if err := worker.ValidateJobRouting(queue, priority); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	status := models.JobStatusPending
+	var runAt *time.Time
+	if v := c.GetHeader("X-Amz-Meta-Run-At"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run-at time, expected RFC 3339: " + v})
+			return
+		}
+		runAt = &t
+		if t.After(time.Now()) {
+			status = models.JobStatusScheduled
+		}
+	}
+	var expiresAt *time.Time
+	if v := c.GetHeader("X-Amz-Meta-Expires-At"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expires-at time, expected RFC 3339: " + v})
+			return
+		}
+		expiresAt = &t
+	}
+	if err := worker.ValidateJobExpiry(expiresAt, runAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Build S3 key with user prefix
 	s3Key := fmt.Sprintf("users/%d/%s", userID, key)
 
+	// A retried upload with the same idempotency key doesn't upload again or create another
+	// job. The key is bound to the object it was first used for.
+	idempotencyKey := c.GetHeader("X-Amz-Meta-Idempotency-Key")
+	if err := worker.ValidateIdempotencyKey(idempotencyKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	idempotencyRequest := "PUT " + s3Key
+	if idempotencyKey != "" {
+		existing, err := worker.FindIdempotentJob(h.db, userID, idempotencyKey, idempotencyRequest)
+		if errors.Is(err, worker.ErrIdempotencyKeyReused) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+			return
+		}
+		if existing != nil {
+			c.Header("ETag", fmt.Sprintf("\"%s\"", existing.File.S3Key))
+			c.Header("Idempotent-Replayed", "true")
+			c.Status(http.StatusOK)
+			return
+		}
+	}
+
+	// Refuse the upload before storing it if its job would exceed the user's queued jobs.
+	// S3 clients back off and retry on 503 Slow Down.
+	if c.GetHeader("X-Amz-Meta-Pipeline") != "" {
+		err := worker.CheckQueuedLimit(h.db, h.config, userID, 1)
+		var limitErr *worker.QueuedLimitError
+		if errors.As(err, &limitErr) {
+			c.Header("Retry-After", "30")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "SlowDown: " + limitErr.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check job limits"})
+			return
+		}
+	}
+
+	// Look up the pipeline and check the job's parameters (X-Amz-Meta-Param-* headers)
+	// before uploading, too
+	var pipelineRecord *models.Pipeline
+	var pipelineVersion *models.PipelineVersion
+	var params map[string]interface{}
+	if pipelineName := c.GetHeader("X-Amz-Meta-Pipeline"); pipelineName != "" {
+		var record models.Pipeline
+		if err := h.db.Where("user_id = ? AND name = ?", userID, pipelineName).First(&record).Error; err == nil {
+			pipelineVersion, err = worker.CurrentPipelineVersion(h.db, &record)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipeline version"})
+				return
+			}
+			definition, err := worker.ParsePipeline(pipelineVersion.Format, pipelineVersion.Content)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse pipeline"})
+				return
+			}
+			params, err = definition.ResolveParams(metadataParams(c.Request.Header, definition.Parameters))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pipeline parameters: " + err.Error()})
+				return
+			}
+			pipelineRecord = &record
+		} else {
+			fmt.Printf("Warning: Pipeline '%s' not found for user %d\n", pipelineName, userID)
+		}
+	}
+
 	// Read request body into memory
 	bodyBytes, err := io.ReadAll(c.Request.Body)
 	if err != nil {
@@ -104,31 +226,32 @@ func (h *S3Handler) PutObject(c *gin.Context) {
 		return
 	}
 
-	// Check for pipeline name in metadata (X-Amz-Meta-Pipeline header)
-	pipelineName := c.GetHeader("X-Amz-Meta-Pipeline")
-	if pipelineName != "" {
-		// Look up pipeline by name
-		var pipelineRecord models.Pipeline
-		if err := h.db.Where("user_id = ? AND name = ?", userID, pipelineName).First(&pipelineRecord).Error; err == nil {
-			// Create job with pipeline
-			job := models.Job{
-				FileID:     fileRecord.ID,
-				PipelineID: &pipelineRecord.ID,
-				Status:     models.JobStatusPending,
-			}
+	// Create a job if the upload names a pipeline (X-Amz-Meta-Pipeline header)
+	if pipelineRecord != nil {
+		paramsJSON, _ := json.Marshal(params)
+		job := models.Job{
+			FileID:            fileRecord.ID,
+			PipelineID:        &pipelineRecord.ID,
+			PipelineVersionID: &pipelineVersion.ID,
+			Params:            paramsJSON,
+			Status:            status,
+			Priority:          priority,
+			Queue:             queue,
+			Capabilities:      worker.JobCapabilities(pipelineVersion, params),
+			RunAt:             runAt,
+			ExpiresAt:         worker.JobExpiry(pipelineVersion, runAt, expiresAt),
+		}
 
-			if err := h.db.Create(&job).Error; err != nil {
-				fmt.Printf("Warning: Failed to create job: %v\n", err)
-			} else {
-				// Publish job notification to Redis
-				if h.redis != nil {
-					if err := h.redis.PublishJobNotification(job.ID); err != nil {
-						fmt.Printf("Warning: Failed to publish job notification: %v\n", err)
-					}
+		if replayed, err := worker.CreateJobOnce(h.db, &job, userID, idempotencyKey, idempotencyRequest, h.config.IdempotencyKeyTTL); err != nil {
+			fmt.Printf("Warning: Failed to create job: %v\n", err)
+		} else if !replayed {
+			// Enqueue job on the queue; scheduled jobs are enqueued by the scheduler once due
+			if job.Status == models.JobStatusPending && h.queue != nil {
+				job.File = fileRecord
+				if err := h.queue.Enqueue(&job); err != nil {
+					fmt.Printf("Warning: Failed to enqueue job: %v\n", err)
 				}
 			}
-		} else {
-			fmt.Printf("Warning: Pipeline '%s' not found for user %d\n", pipelineName, userID)
 		}
 	}
 
@@ -303,3 +426,25 @@ func (h *S3Handler) ListObjects(c *gin.Context) {
 
 	c.XML(http.StatusOK, response)
 }
+
+// metadataParams returns the pipeline parameter values given as X-Amz-Meta-Param-<name>
+// headers. Dashes in names stand for underscores, since proxies may drop headers with
+// underscores, and names match the declared parameters regardless of case, since header
+// names aren't case-sensitive. Undeclared names are kept, to be rejected as unknown.
+func metadataParams(header http.Header, declared map[string]pipeline.Parameter) map[string]interface{} {
+	const prefix = "X-Amz-Meta-Param-"
+	names := slices.Sorted(maps.Keys(declared))
+	values := make(map[string]interface{})
+	for name, value := range header {
+		if strings.HasPrefix(name, prefix) && len(value) > 0 {
+			param := strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(name, prefix)), "-", "_")
+			if _, ok := declared[param]; !ok {
+				if i := slices.IndexFunc(names, func(n string) bool { return strings.EqualFold(n, param) }); i >= 0 {
+					param = names[i]
+				}
+			}
+			values[param] = value[0]
+		}
+	}
+	return values
+}
@@ -3,23 +3,45 @@ package system
 import (
 	"fmt"
 	"os/exec"
+	"sort"
+	"strings"
 )
 
+// Capabilities a worker can advertise, in addition to the ffmpeg encoders it supports
+const (
+	CapabilityFFmpeg      = "ffmpeg"
+	CapabilityImageMagick = "imagemagick"
+	CapabilityPDFToText   = "pdftotext"
+)
+
+// requiredTools lists the external tools and the capability each of them provides
+var requiredTools = []struct {
+	name       string
+	capability string
+}{
+	{"ffmpeg", CapabilityFFmpeg},
+	{"magick", CapabilityImageMagick},
+	{"pdftotext", CapabilityPDFToText},
+}
+
+// Encoders are the ffmpeg encoders that are probed and advertised as capabilities
+var Encoders = []string{
+	"libx264", "libx265", "libvpx-vp9", "libaom-av1", "libsvtav1",
+	"h264_nvenc", "hevc_nvenc", "aac", "libopus", "libmp3lame",
+}
+
+// EncoderCapability returns the capability that stands for an ffmpeg encoder
+func EncoderCapability(encoder string) string {
+	return "encoder:" + encoder
+}
+
 // CheckDependencies verifies that required external tools are available in the PATH.
 func CheckDependencies() error {
-	requiredTools := []string{"ffmpeg", "magick", "pdftotext"}
 	missingTools := []string{}
 
 	for _, tool := range requiredTools {
-		_, err := exec.LookPath(tool)
-		if err != nil {
-			// Special case for ImageMagick: older versions use 'convert'
-			if tool == "magick" {
-				if _, err := exec.LookPath("convert"); err == nil {
-					continue
-				}
-			}
-			missingTools = append(missingTools, tool)
+		if !hasTool(tool.name) {
+			missingTools = append(missingTools, tool.name)
 		}
 	}
 
@@ -29,3 +51,87 @@ func CheckDependencies() error {
 
 	return nil
 }
+
+// DetectCapabilities reports which of the required tools are available, and which
+// of the probed ffmpeg encoders the installed ffmpeg supports
+func DetectCapabilities() []string {
+	var capabilities []string
+
+	for _, tool := range requiredTools {
+		if hasTool(tool.name) {
+			capabilities = append(capabilities, tool.capability)
+		}
+	}
+
+	if hasTool("ffmpeg") {
+		available := ffmpegEncoders()
+		for _, encoder := range Encoders {
+			if available[encoder] {
+				capabilities = append(capabilities, EncoderCapability(encoder))
+			}
+		}
+	}
+
+	sort.Strings(capabilities)
+	return capabilities
+}
+
+func hasTool(tool string) bool {
+	if _, err := exec.LookPath(tool); err == nil {
+		return true
+	}
+	// Special case for ImageMagick: older versions use 'convert'
+	if tool == "magick" {
+		if _, err := exec.LookPath("convert"); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ffmpegEncoders lists the encoders the installed ffmpeg was built with
+func ffmpegEncoders() map[string]bool {
+	encoders := make(map[string]bool)
+
+	output, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return encoders
+	}
+
+	// Encoder lines look like " V....D libx264              libx264 H.264 / AVC ..."
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && len(fields[0]) == 6 && fields[1] != "=" {
+			encoders[fields[1]] = true
+		}
+	}
+
+	return encoders
+}
+
+// ToolVersions reports the version line of each external tool that is installed
+func ToolVersions() map[string]string {
+	checks := []struct {
+		name string
+		args []string
+	}{
+		{"ffmpeg", []string{"-version"}},
+		{"ffprobe", []string{"-version"}},
+		{"magick", []string{"-version"}},
+		{"convert", []string{"-version"}},
+		{"pdftotext", []string{"-v"}},
+	}
+
+	versions := make(map[string]string)
+	for _, check := range checks {
+		if _, err := exec.LookPath(check.name); err != nil {
+			continue
+		}
+		// pdftotext prints its version to stderr
+		output, _ := exec.Command(check.name, check.args...).CombinedOutput()
+		firstLine, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+		versions[check.name] = strings.TrimSpace(firstLine)
+	}
+
+	return versions
+}
@@ -0,0 +1,5 @@
+package system
+
+// Version is the build version, set at build time with
+// -ldflags "-X github.com/mukund/mediaconvert/internal/system.Version=..."
+var Version = "dev"
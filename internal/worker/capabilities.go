@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/mukund/mediaconvert/internal/models"
+	"github.com/mukund/mediaconvert/internal/pipeline"
+	"gorm.io/gorm"
+)
+
+// StepCapabilities returns the capabilities a worker needs to run a step, as its
+// operation reports them. Steps with unknown operations need none; they fail on any worker.
+func StepCapabilities(step pipeline.Step) []string {
+	op, ok := pipeline.LookupOperation(step.Operation)
+	if !ok {
+		return nil
+	}
+	return op.Capabilities(step)
+}
+
+// PipelineCapabilities returns the capabilities needed to run all steps of a pipeline,
+// including the ones it declares, sorted and without duplicates
+func PipelineCapabilities(p *pipeline.Pipeline) []string {
+	capabilities := append([]string{}, p.Requires...)
+	for _, step := range p.Steps {
+		capabilities = append(capabilities, StepCapabilities(step)...)
+	}
+
+	sort.Strings(capabilities)
+	return slices.Compact(capabilities)
+}
+
+// JobCapabilities returns the capabilities a job running the pipeline version with the
+// given parameter values needs, in the form stored on the job. Pipelines that can't be
+// parsed need none; they fail on any worker.
+func JobCapabilities(version *models.PipelineVersion, params map[string]interface{}) string {
+	p, err := parsePipelineVersion(version)
+	if err != nil {
+		return ""
+	}
+
+	// Parameters may choose codecs
+	vars := pipeline.ParamVariables(params)
+	for i := range p.Steps {
+		p.Steps[i].Params = pipeline.SubstituteParams(p.Steps[i].Params, vars)
+	}
+	return strings.Join(PipelineCapabilities(p), ",")
+}
+
+// ResolveJobParams checks the parameter values supplied for a job running the pipeline
+// version, returning the values of all its parameters
+func ResolveJobParams(version *models.PipelineVersion, values map[string]interface{}) (map[string]interface{}, error) {
+	p, err := parsePipelineVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline: %w", err)
+	}
+	return p.ResolveParams(values)
+}
+
+// parsePipelineVersion parses the definition of a version of a saved pipeline
+func parsePipelineVersion(version *models.PipelineVersion) (*pipeline.Pipeline, error) {
+	return ParsePipeline(version.Format, version.Content)
+}
+
+// jobPipeline parses the pipeline a job runs: the version it is pinned to, or the current
+// version of its pipeline for jobs submitted before versions were kept. The job's Pipeline
+// and PipelineVersion must be loaded.
+func jobPipeline(job *models.Job) (*pipeline.Pipeline, error) {
+	switch {
+	case job.PipelineVersion != nil:
+		return parsePipelineVersion(job.PipelineVersion)
+	case job.Pipeline != nil:
+		return ParsePipeline(job.Pipeline.Format, job.Pipeline.Content)
+	default:
+		return nil, fmt.Errorf("no pipeline specified")
+	}
+}
+
+// ParsePipeline parses a pipeline definition in the given format
+func ParsePipeline(format models.PipelineFormat, content string) (*pipeline.Pipeline, error) {
+	if format == models.PipelineFormatYAML {
+		return pipeline.ParseYAML([]byte(content))
+	}
+	return pipeline.ParseJSON([]byte(content))
+}
+
+// CurrentPipelineVersion returns the current version of a saved pipeline, which new jobs
+// are pinned to
+func CurrentPipelineVersion(db *gorm.DB, record *models.Pipeline) (*models.PipelineVersion, error) {
+	var version models.PipelineVersion
+	if err := db.Where("pipeline_id = ? AND version = ?", record.ID, record.Version).First(&version).Error; err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// hasCapabilities reports whether a worker with the given capabilities can run a job
+// needing the required ones (as stored on the job)
+func hasCapabilities(capabilities []string, required string) bool {
+	if required == "" {
+		return true
+	}
+	for _, capability := range strings.Split(required, ",") {
+		if !slices.Contains(capabilities, capability) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,74 +1,424 @@
 package worker
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/mukund/mediaconvert/internal/pipeline"
 )
 
 // ExecutionContext holds context for pipeline execution
 type ExecutionContext struct {
-	InputFile  string
-	OutputDir  string
-	WorkDir    string
-	Variables  map[string]string
+	InputFile   string
+	OutputDir   string
+	WorkDir     string
+	Variables   map[string]interface{} // Parameters and built-in variables, by name
+	StepOutputs map[string]string      // Output paths of the finished steps, by step ID
 }
 
-// ExecutePipeline executes all steps in a pipeline
-func ExecutePipeline(p *pipeline.Pipeline, inputFile, workDir string) ([]string, error) {
+// stepResult is the outcome of a step run by ExecutePipeline
+type stepResult struct {
+	index int
+	err   error
+}
+
+// PipelineInput is the file a pipeline runs on
+type PipelineInput struct {
+	Path       string                   // Local path of the downloaded file
+	Properties pipeline.MediaProperties // For evaluating step conditions
+	Variables  map[string]interface{}   // Parameters and built-in variables, by name
+}
+
+// SkippedStep describes a step that didn't run, as recorded in a job's result info
+type SkippedStep struct {
+	Step      int    `json:"step"`
+	ID        string `json:"id,omitempty"`
+	Operation string `json:"operation"`
+	Reason    string `json:"reason"`
+}
+
+// ExecutePipeline executes the steps of a pipeline, stopping the running tools if runCtx is cancelled.
+// Steps start once the steps they depend on have completed, with up to maxParallel steps
+// (or fewer, if the pipeline asks for it) running at once. When a step fails, no more steps
+// are started and the running ones are stopped.
+// Steps whose `when` condition doesn't hold for the input's properties are skipped, as are
+// the steps using their outputs. The input's variables are substituted in the steps' paths
+// and params.
+// Each step runs under the default limits, overridden by the limits the step declares.
+// Progress is reported at each step, and continuously while ffmpeg runs. The command
+// line, output, exit code and duration of each step are written to a log in workDir.
+// The outputs of the steps that ran are returned in step order, with the skipped steps.
+func ExecutePipeline(runCtx context.Context, p *pipeline.Pipeline, input PipelineInput, workDir string, defaults ResourceLimits, maxParallel int, report ProgressFunc) ([]string, []SkippedStep, error) {
+	deps, err := p.Dependencies()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.MaxParallel > 0 && p.MaxParallel < maxParallel {
+		maxParallel = p.MaxParallel
+	}
+	maxParallel = max(maxParallel, 1)
+
 	// Create output directory
 	outputDir := filepath.Join(workDir, "output")
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create output directory: %w", err)
+		return nil, nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	logsDir := StepLogsDir(workDir)
+	if err := os.MkdirAll(logsDir, 0755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create logs directory: %w", err)
 	}
 
 	ctx := &ExecutionContext{
-		InputFile: inputFile,
-		OutputDir: outputDir,
-		WorkDir:   workDir,
-		Variables: make(map[string]string),
+		InputFile:   input.Path,
+		OutputDir:   outputDir,
+		WorkDir:     workDir,
+		Variables:   input.Variables,
+		StepOutputs: make(map[string]string),
+	}
+
+	// Steps waiting on others, and the steps waiting on each step
+	waitingOn := make([]int, len(p.Steps))
+	dependents := make([][]int, len(p.Steps))
+	var ready []int
+	for i, stepDeps := range deps {
+		waitingOn[i] = len(stepDeps)
+		for _, j := range stepDeps {
+			dependents[j] = append(dependents[j], i)
+		}
+		if len(stepDeps) == 0 {
+			ready = append(ready, i)
+		}
 	}
 
-	var outputFiles []string
+	stepsCtx, stopSteps := context.WithCancel(runCtx)
+	defer stopSteps()
 
-	// Execute each step sequentially
-	for i, step := range p.Steps {
-		fmt.Printf("Executing step %d: %s (%s)\n", i+1, step.Operation, step.Output)
+	outputFiles := make([]string, len(p.Steps))
+	progress := newProgressTracker(len(p.Steps), report)
+	results := make(chan stepResult)
+	running, completed := 0, 0
+	skipped := []SkippedStep{}
+	skippedIDs := make(map[string]bool)
+	var firstErr error
 
-		// Map operation to command
-		cmd, err := MapOperation(step, ctx)
-		if err != nil {
-			return nil, fmt.Errorf("step %d: failed to map operation: %w", i+1, err)
+	// done marks a step as completed or skipped, readying the steps waiting on it
+	done := func(i int) {
+		completed++
+		progress.finishStep(i + 1)
+		for _, j := range dependents[i] {
+			waitingOn[j]--
+			if waitingOn[j] == 0 {
+				ready = append(ready, j)
+			}
 		}
+		slices.Sort(ready)
+	}
+
+	for completed < len(p.Steps) {
+		// Start the steps whose dependencies completed, unless a step failed
+		for firstErr == nil && len(ready) > 0 && running < maxParallel {
+			i := ready[0]
+			ready = ready[1:]
+			step := p.Steps[i]
 
-		// Execute command
-		if err := executeCommand(cmd); err != nil {
-			return nil, fmt.Errorf("step %d: command failed: %w", i+1, err)
+			reason, err := skipReason(step, input.Properties, skippedIDs)
+			if err != nil {
+				firstErr = fmt.Errorf("step %d: %w", i+1, err)
+				stopSteps()
+				break
+			}
+			if reason != "" {
+				fmt.Printf("Skipping step %d: %s\n", i+1, reason)
+				skipped = append(skipped, SkippedStep{Step: i + 1, ID: step.ID, Operation: step.Operation, Reason: reason})
+				if step.ID != "" {
+					skippedIDs[step.ID] = true
+				}
+				done(i)
+				continue
+			}
+
+			// Steps are resolved here, where the outputs of finished steps are known
+			step.Params = pipeline.SubstituteParams(step.Params, stepVariables(ctx))
+			step.Input = substituteVars(step.Input, ctx)
+			step.Output = substituteVars(step.Output, ctx)
+			op, cmd, err := stepOperation(step)
+			if err != nil {
+				firstErr = fmt.Errorf("step %d: %w", i+1, err)
+				stopSteps()
+				break
+			}
+			outputFiles[i] = step.Output
+
+			running++
+			go func() {
+				results <- stepResult{index: i, err: runStep(stepsCtx, runCtx, i+1, step, op, cmd, logsDir, defaults, progress)}
+			}()
+		}
+		if running == 0 {
+			break
 		}
 
-		// Track output file
-		outputPath := substituteVars(step.Output, ctx)
-		outputFiles = append(outputFiles, outputPath)
+		result := <-results
+		running--
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+				stopSteps()
+			}
+			continue
+		}
 
-		fmt.Printf("Step %d completed: %s\n", i+1, outputPath)
+		step := p.Steps[result.index]
+		if step.ID != "" {
+			ctx.StepOutputs[step.ID] = outputFiles[result.index]
+		}
+		fmt.Printf("Step %d completed: %s\n", result.index+1, outputFiles[result.index])
+		done(result.index)
+	}
+	if firstErr != nil {
+		return nil, skipped, firstErr
+	}
+	if len(p.Steps) > 0 {
+		progress.finish(p.Steps[len(p.Steps)-1].Operation)
+	}
+
+	// Skipped steps have no output
+	outputFiles = slices.DeleteFunc(outputFiles, func(path string) bool { return path == "" })
+	return outputFiles, skipped, nil
+}
+
+// skipReason returns why a step should be skipped, or "" if it should run: its condition
+// doesn't hold, or it uses the output of a skipped step
+func skipReason(step pipeline.Step, props pipeline.MediaProperties, skippedIDs map[string]bool) (string, error) {
+	for _, id := range step.ReferencedSteps() {
+		if skippedIDs[id] {
+			return fmt.Sprintf("uses the output of skipped step %q", id), nil
+		}
 	}
 
-	return outputFiles, nil
+	if step.When == "" {
+		return "", nil
+	}
+	condition, err := pipeline.ParseCondition(step.When)
+	if err != nil {
+		return "", fmt.Errorf("invalid when: %w", err)
+	}
+	if !condition.Eval(props) {
+		return fmt.Sprintf("condition %q is false", step.When), nil
+	}
+	return "", nil
 }
 
-func executeCommand(cmd *OperationCommand) error {
+// stepOperation returns the registered operation of a resolved step, with the command to
+// run if it runs an external tool
+func stepOperation(step pipeline.Step) (pipeline.Operation, *pipeline.Command, error) {
+	op, ok := pipeline.LookupOperation(step.Operation)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported operation: %s", step.Operation)
+	}
+	cmdOp, ok := op.(pipeline.CommandOperation)
+	if !ok {
+		return op, nil, nil
+	}
+	cmd, err := cmdOp.Command(step)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build command: %w", err)
+	}
+	return op, cmd, nil
+}
+
+// runStep runs a (1-based) step, writing its log: the command of an operation running an
+// external tool, within the step's limits, or an in-process operation, within its timeout.
+// stepsCtx stops the step along with the others; runCtx is the job's context.
+func runStep(stepsCtx, runCtx context.Context, n int, step pipeline.Step, op pipeline.Operation, cmd *pipeline.Command, logsDir string, defaults ResourceLimits, progress *progressTracker) error {
+	fmt.Printf("Executing step %d: %s (%s)\n", n, step.Operation, step.Output)
+	progress.startStep(n, step.Operation)
+
+	limits := defaults.ForStep(step)
+	stepCtx, cancel := stepsCtx, context.CancelFunc(func() {})
+	if limits.Timeout > 0 {
+		stepCtx, cancel = context.WithTimeout(stepsCtx, limits.Timeout)
+	}
+	defer cancel()
+
+	var progressOut io.Writer
+	if cmd != nil && cmd.Tool == "ffmpeg" {
+		progressOut = ffmpegProgress(stepCtx, cmd, step.Input, func(fraction float64) {
+			progress.stepProgress(n, step.Operation, fraction)
+		})
+	}
+	logFile, logErr := os.Create(filepath.Join(logsDir, StepLogName(n)))
+	if logErr != nil {
+		fmt.Printf("Warning: failed to create log for step %d: %v\n", n, logErr)
+	}
+	var logOut io.Writer
+	if logFile != nil {
+		fmt.Fprintf(logFile, "# Step %d (%s), started %s\n", n, step.Operation, time.Now().Format(time.RFC3339))
+		logOut = logFile
+		defer logFile.Close()
+	}
+
+	var err error
+	if cmd != nil {
+		err = executeCommand(stepCtx, cmd, limits, progressOut, logOut)
+	} else {
+		err = runInProcess(stepCtx, op.(pipeline.InProcessOperation), step, logOut)
+	}
+	if err != nil {
+		if runCtx.Err() == nil && errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+			return &StepTimeoutError{Step: n, Operation: step.Operation, Timeout: limits.Timeout}
+		}
+		if cmd == nil {
+			return fmt.Errorf("step %d: %w", n, err)
+		}
+		return fmt.Errorf("step %d: command failed: %w", n, err)
+	}
+	return nil
+}
+
+// runInProcess runs an in-process operation, writing its result to logOut if set
+func runInProcess(ctx context.Context, op pipeline.InProcessOperation, step pipeline.Step, logOut io.Writer) error {
+	fmt.Printf("Running in process: %s\n", step.Operation)
+
+	log := io.Discard
+	if logOut != nil {
+		log = logOut
+	}
+	started := time.Now()
+	err := op.Run(ctx, step, log)
+	if logOut != nil {
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+		}
+		fmt.Fprintf(logOut, "\n--- %s, duration %s\n", result, time.Since(started).Round(time.Millisecond))
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s stopped: %w", step.Operation, ctx.Err())
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", step.Operation, err)
+	}
+	return nil
+}
+
+// ffmpegProgress makes ffmpeg write machine-readable progress to stdout and returns a
+// writer that reports it relative to the input's duration. Without a known duration,
+// the step only reports completion.
+func ffmpegProgress(ctx context.Context, cmd *pipeline.Command, input string, onUpdate func(fraction float64)) io.Writer {
+	duration, err := probeDuration(ctx, input)
+	if err != nil || duration <= 0 {
+		return nil
+	}
+
+	cmd.Args = append([]string{"-progress", "pipe:1", "-nostats"}, cmd.Args...)
+	onUpdate(0)
+	return &ffmpegProgressWriter{duration: duration, onUpdate: onUpdate}
+}
+
+// StepLogsDir returns the directory step logs are written to for a work directory
+func StepLogsDir(workDir string) string {
+	return filepath.Join(workDir, "logs")
+}
+
+// StepLogName returns the file name of the log of a (1-based) step
+func StepLogName(step int) string {
+	return fmt.Sprintf("step-%d.log", step)
+}
+
+// executeCommand runs a tool, capturing its output for error reports and writing the
+// command line, output and result to logOut if set. If progressOut is set, the tool's
+// stdout is sent there instead.
+func executeCommand(ctx context.Context, cmd *pipeline.Command, limits ResourceLimits, progressOut, logOut io.Writer) error {
 	fmt.Printf("Running: %s %v\n", cmd.Tool, cmd.Args)
 
-	command := exec.Command(cmd.Tool, cmd.Args...)
+	command := exec.CommandContext(ctx, cmd.Tool, cmd.Args...)
+	setProcessGroup(command)
+	// Don't wait forever on output pipes held open by orphaned helper processes
+	command.WaitDelay = 5 * time.Second
 
 	// Capture output
-	output, err := command.CombinedOutput()
+	var output bytes.Buffer
+	var sink io.Writer = &output
+	if logOut != nil {
+		fmt.Fprintf(logOut, "$ %s\n\n", commandLine(cmd))
+		sink = io.MultiWriter(&output, logOut)
+	}
+	command.Stdout = sink
+	command.Stderr = sink
+	if progressOut != nil {
+		command.Stdout = progressOut
+	}
+
+	started := time.Now()
+	err := runWithLimits(command, limits)
+	if logOut != nil {
+		fmt.Fprintf(logOut, "\n--- exit code %d, duration %s\n", exitCode(err), time.Since(started).Round(time.Millisecond))
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s stopped: %w", cmd.Tool, ctx.Err())
+	}
 	if err != nil {
-		return fmt.Errorf("%s failed: %w\nOutput: %s", cmd.Tool, err, string(output))
+		return fmt.Errorf("%s failed: %w\nOutput: %s", cmd.Tool, err, output.String())
 	}
 
 	return nil
 }
+
+// commandLine formats a command for logs, quoting arguments that contain spaces
+func commandLine(cmd *pipeline.Command) string {
+	parts := []string{cmd.Tool}
+	for _, arg := range cmd.Args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = fmt.Sprintf("%q", arg)
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// exitCode returns the exit code of a finished command, or -1 if it didn't exit normally
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// stepVariables returns the variables substituted in step params: the input's variables and
+// the outputs of the finished steps, as steps.<id>.output
+func stepVariables(ctx *ExecutionContext) map[string]interface{} {
+	vars := maps.Clone(ctx.Variables)
+	if vars == nil {
+		vars = make(map[string]interface{}, len(ctx.StepOutputs))
+	}
+	for id, output := range ctx.StepOutputs {
+		vars["steps."+id+".output"] = output
+	}
+	return vars
+}
+
+// substituteVars replaces the input, output, variable and step output references in s
+func substituteVars(s string, ctx *ExecutionContext) string {
+	s = strings.ReplaceAll(s, "${input}", ctx.InputFile)
+	s = strings.ReplaceAll(s, "${output}", ctx.OutputDir)
+	s = pipeline.Substitute(s, ctx.Variables)
+	s = pipeline.ReplaceStepRefs(s, func(id string) string {
+		return ctx.StepOutputs[id]
+	})
+	return s
+}
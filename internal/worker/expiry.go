@@ -0,0 +1,118 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mukund/mediaconvert/internal/analytics"
+	"github.com/mukund/mediaconvert/internal/models"
+	"gorm.io/gorm"
+)
+
+// JobExpiry returns when a job stops being useful: the requested time if given, otherwise
+// the deadline of the pipeline version counted from when the job may first run. It returns
+// nil if the job doesn't expire.
+func JobExpiry(version *models.PipelineVersion, runAt, requested *time.Time) *time.Time {
+	if requested != nil {
+		return requested
+	}
+	if version == nil {
+		return nil
+	}
+
+	p, err := parsePipelineVersion(version)
+	if err != nil || p.Deadline == "" {
+		return nil
+	}
+	deadline, err := time.ParseDuration(p.Deadline)
+	if err != nil || deadline <= 0 {
+		return nil
+	}
+
+	start := time.Now()
+	if runAt != nil && runAt.After(start) {
+		start = *runAt
+	}
+	expiresAt := start.Add(deadline)
+	return &expiresAt
+}
+
+// ValidateJobExpiry checks an expires_at time a job is submitted with
+func ValidateJobExpiry(expiresAt, runAt *time.Time) error {
+	if expiresAt == nil {
+		return nil
+	}
+	if !expiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+	if runAt != nil && !expiresAt.After(*runAt) {
+		return errors.New("expires_at must be after run_at")
+	}
+	return nil
+}
+
+// expireJob ends a job whose expires_at time passed: a waiting job moves to expired and a
+// processing one is cancelled, and the worker running it is told to stop. It reports
+// whether the job was ended, which it isn't if its status changed in the meantime.
+func expireJob(ctx context.Context, db *gorm.DB, analyticsClient *analytics.Client, canceller Canceller, job *models.Job) (bool, error) {
+	from := job.Status
+	to := models.JobStatusExpired
+	message := fmt.Sprintf("Expired at %s before a worker started it", job.ExpiresAt.Format(time.RFC3339))
+	if from == models.JobStatusProcessing {
+		to = models.JobStatusCanceled
+		message = fmt.Sprintf("Cancelled: deadline %s passed while processing", job.ExpiresAt.Format(time.RFC3339))
+	}
+
+	now := time.Now()
+	result := db.Model(&models.Job{}).
+		Where("id = ? AND status = ?", job.ID, from).
+		Updates(map[string]interface{}{
+			"status":           to,
+			"error":            message,
+			"finished_at":      now,
+			"lease_owner":      "",
+			"lease_expires_at": nil,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	job.Status = to
+	job.Error = message
+	job.FinishedAt = &now
+	recordTransition(ctx, db, analyticsClient, job, from, to, message, "system")
+
+	if from == models.JobStatusProcessing {
+		if err := canceller.PublishJobCancel(job.ID); err != nil {
+			log.Printf("Failed to publish cancel signal for job %d: %v", job.ID, err)
+		}
+	}
+	return true, nil
+}
+
+// ExpireJobs ends the jobs whose expires_at time passed: waiting jobs expire and
+// processing ones are cancelled
+func (r *Reaper) ExpireJobs(ctx context.Context) error {
+	statuses := append([]models.JobStatus{models.JobStatusProcessing}, queuedStatuses...)
+
+	var jobs []models.Job
+	if err := r.db.Preload("File").
+		Where("expires_at < ? AND status IN ?", time.Now(), statuses).
+		Order("expires_at").
+		Limit(500).
+		Find(&jobs).Error; err != nil {
+		return fmt.Errorf("failed to find expired jobs: %w", err)
+	}
+
+	for _, job := range jobs {
+		if _, err := expireJob(ctx, r.db, r.analytics, r.canceller, &job); err != nil {
+			log.Printf("Failed to expire job %d: %v", job.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mukund/mediaconvert/internal/config"
+	"github.com/mukund/mediaconvert/internal/models"
+	"gorm.io/gorm"
+)
+
+// userLockSpace namespaces the advisory locks taken while claiming a user's jobs
+const userLockSpace = 0x6a6f6273
+
+// concurrencyRetryDelay is how long a job is held back when its user already runs as
+// many jobs as they may
+const concurrencyRetryDelay = 5 * time.Second
+
+// errConcurrencyLimit is returned when a job can't be claimed because its user is at
+// their concurrency limit
+var errConcurrencyLimit = errors.New("user is at their concurrency limit")
+
+// queuedStatuses are the statuses of jobs waiting to run
+var queuedStatuses = []models.JobStatus{
+	models.JobStatusPending,
+	models.JobStatusScheduled,
+	models.JobStatusRetrying,
+}
+
+// UserJobLimits limits how many jobs a user may have running and waiting. Zero means
+// no limit.
+type UserJobLimits struct {
+	MaxConcurrent int
+	MaxQueued     int
+}
+
+// JobLimitsFor returns the limits of a user, falling back to the configured defaults for
+// limits the user doesn't override
+func JobLimitsFor(cfg *config.Config, user models.User) UserJobLimits {
+	limits := UserJobLimits{
+		MaxConcurrent: cfg.UserMaxConcurrentJobs,
+		MaxQueued:     cfg.UserMaxQueuedJobs,
+	}
+	if user.MaxConcurrentJobs != nil {
+		limits.MaxConcurrent = *user.MaxConcurrentJobs
+	}
+	if user.MaxQueuedJobs != nil {
+		limits.MaxQueued = *user.MaxQueuedJobs
+	}
+	return limits
+}
+
+// LoadJobLimits returns the limits of the user with the given ID
+func LoadJobLimits(db *gorm.DB, cfg *config.Config, userID uint) (UserJobLimits, error) {
+	var user models.User
+	if err := db.Select("id", "max_concurrent_jobs", "max_queued_jobs").First(&user, userID).Error; err != nil {
+		return UserJobLimits{}, err
+	}
+	return JobLimitsFor(cfg, user), nil
+}
+
+// QueuedLimitError is returned when submitting jobs would take a user over their limit
+// of queued jobs
+type QueuedLimitError struct {
+	Limit  int
+	Queued int64
+}
+
+func (e *QueuedLimitError) Error() string {
+	return fmt.Sprintf("too many queued jobs: %d of %d allowed are waiting to run, try again once some have finished", e.Queued, e.Limit)
+}
+
+// CheckQueuedLimit returns a *QueuedLimitError if adding n jobs would take the user over
+// their limit of queued jobs. Concurrent submissions may overshoot the limit slightly.
+func CheckQueuedLimit(db *gorm.DB, cfg *config.Config, userID uint, n int) error {
+	limits, err := LoadJobLimits(db, cfg, userID)
+	if err != nil {
+		return err
+	}
+	if limits.MaxQueued <= 0 {
+		return nil
+	}
+
+	var queued int64
+	if err := db.Model(&models.Job{}).
+		Joins("JOIN files ON files.id = jobs.file_id").
+		Where("files.user_id = ? AND jobs.status IN ?", userID, queuedStatuses).
+		Count(&queued).Error; err != nil {
+		return err
+	}
+	if queued+int64(n) > int64(limits.MaxQueued) {
+		return &QueuedLimitError{Limit: limits.MaxQueued, Queued: queued}
+	}
+	return nil
+}
+
+// runningJobs counts the user's jobs held by a live lease, other than the given job
+func runningJobs(tx *gorm.DB, userID, exceptJobID uint, now time.Time) (int64, error) {
+	var running int64
+	err := tx.Model(&models.Job{}).
+		Joins("JOIN files ON files.id = jobs.file_id").
+		Where("files.user_id = ? AND jobs.id <> ? AND jobs.status = ? AND jobs.lease_expires_at >= ?",
+			userID, exceptJobID, models.JobStatusProcessing, now).
+		Count(&running).Error
+	return running, err
+}
+
+// claimWithinLimit runs claim unless the user already runs as many jobs as their
+// concurrency limit allows, in which case it returns errConcurrencyLimit. Claims for the
+// same user are serialized so that concurrent workers can't overshoot the limit.
+func claimWithinLimit(db *gorm.DB, cfg *config.Config, userID, jobID uint, now time.Time, claim func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		limits, err := LoadJobLimits(tx, cfg, userID)
+		if err != nil {
+			return err
+		}
+		if limits.MaxConcurrent > 0 {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?, ?)", userLockSpace, userID).Error; err != nil {
+				return err
+			}
+			running, err := runningJobs(tx, userID, jobID, now)
+			if err != nil {
+				return err
+			}
+			if running >= int64(limits.MaxConcurrent) {
+				return errConcurrencyLimit
+			}
+		}
+		return claim(tx)
+	})
+}
+
+// UsersAtConcurrencyLimit returns the users that run as many jobs as they may, whose
+// jobs workers should leave alone for now
+func (p *JobProcessor) UsersAtConcurrencyLimit() (map[uint]bool, error) {
+	var rows []struct {
+		UserID            uint
+		MaxConcurrentJobs *int
+		Running           int64
+	}
+	err := p.db.Model(&models.Job{}).
+		Select("files.user_id, users.max_concurrent_jobs, COUNT(*) AS running").
+		Joins("JOIN files ON files.id = jobs.file_id").
+		Joins("JOIN users ON users.id = files.user_id").
+		Where("jobs.status = ? AND jobs.lease_expires_at >= ?", models.JobStatusProcessing, time.Now()).
+		Group("files.user_id, users.max_concurrent_jobs").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	busy := make(map[uint]bool)
+	for _, row := range rows {
+		limits := JobLimitsFor(p.config, models.User{MaxConcurrentJobs: row.MaxConcurrentJobs})
+		if limits.MaxConcurrent > 0 && row.Running >= int64(limits.MaxConcurrent) {
+			busy[row.UserID] = true
+		}
+	}
+	return busy, nil
+}
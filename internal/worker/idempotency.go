@@ -0,0 +1,110 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mukund/mediaconvert/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxIdempotencyKeyLength is the longest idempotency key clients may send
+const MaxIdempotencyKeyLength = 255
+
+// errIdempotencyKeyTaken is returned inside the job creation transaction when another
+// request created a job with the same key first
+var errIdempotencyKeyTaken = errors.New("idempotency key already used")
+
+// ErrIdempotencyKeyReused is returned when an idempotency key is sent with another request
+// than the one it was first used for
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+
+// ValidateIdempotencyKey checks an idempotency key sent by a client
+func ValidateIdempotencyKey(key string) error {
+	if len(key) > MaxIdempotencyKeyLength {
+		return fmt.Errorf("idempotency key must be at most %d characters", MaxIdempotencyKeyLength)
+	}
+	return nil
+}
+
+// FindIdempotentJob returns the job a user created with the idempotency key, or nil if the
+// key is unused or expired. request identifies the request being made, such as its method,
+// path and target; if the key was used for another request, ErrIdempotencyKeyReused is
+// returned.
+func FindIdempotentJob(db *gorm.DB, userID uint, key, request string) (*models.Job, error) {
+	var record models.IdempotencyKey
+	err := db.Preload("Job.File").Preload("Job.Pipeline").
+		Where("user_id = ? AND key = ? AND expires_at > ?", userID, key, time.Now()).
+		First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.Request != request {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return &record.Job, nil
+}
+
+// CreateJobOnce creates a job, recording the idempotency key and the request it was
+// requested with. If the user already created a job with the key for the same request
+// within the retention window, no job is created; job is replaced by the existing one and
+// replayed is true. If they did for another request, ErrIdempotencyKeyReused is returned.
+// An empty key always creates the job.
+func CreateJobOnce(db *gorm.DB, job *models.Job, userID uint, key, request string, ttl time.Duration) (replayed bool, err error) {
+	if key == "" {
+		return false, db.Create(job).Error
+	}
+
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// An expired key may be reused
+		if err := tx.Where("user_id = ? AND key = ? AND expires_at <= ?", userID, key, now).
+			Delete(&models.IdempotencyKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(job).Error; err != nil {
+			return err
+		}
+
+		// A concurrent request with the same key either committed already or holds the
+		// unique index entry until it does; either way this insert does nothing
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.IdempotencyKey{
+			UserID:    userID,
+			Key:       key,
+			JobID:     job.ID,
+			Request:   request,
+			ExpiresAt: now.Add(ttl),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errIdempotencyKeyTaken
+		}
+		return nil
+	})
+	if !errors.Is(err, errIdempotencyKeyTaken) {
+		return false, err
+	}
+
+	existing, err := FindIdempotentJob(db, userID, key, request)
+	if err != nil {
+		return false, err
+	}
+	if existing == nil {
+		return false, fmt.Errorf("job for idempotency key %q not found", key)
+	}
+	*job = *existing
+	return true, nil
+}
+
+// PurgeExpiredIdempotencyKeys deletes idempotency keys past their retention window
+func PurgeExpiredIdempotencyKeys(db *gorm.DB) (int64, error) {
+	result := db.Where("expires_at <= ?", time.Now()).Delete(&models.IdempotencyKey{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mukund/mediaconvert/internal/config"
+	"github.com/mukund/mediaconvert/internal/pipeline"
+)
+
+// ResourceLimits bounds the external tool run by a pipeline step
+type ResourceLimits struct {
+	Timeout    time.Duration // Wall-clock limit, 0 for none
+	MaxMemory  int64         // Memory limit in bytes, 0 for none
+	Nice       int           // Scheduling niceness (0-19)
+	CPUWeight  int           // cgroup v2 cpu.weight (1-10000), 0 to leave unset
+	CgroupRoot string        // cgroup v2 directory per-step cgroups are created in; rlimits are used if empty (Linux only)
+}
+
+// DefaultResourceLimits builds the global step limits from config
+func DefaultResourceLimits(cfg *config.Config) ResourceLimits {
+	limits := ResourceLimits{
+		Timeout:    cfg.StepTimeout,
+		Nice:       cfg.StepNice,
+		CPUWeight:  cfg.StepCPUWeight,
+		CgroupRoot: cfg.CgroupRoot,
+	}
+	if cfg.StepMaxMemory != "" {
+		if size, err := pipeline.ParseByteSize(cfg.StepMaxMemory); err == nil {
+			limits.MaxMemory = size
+		} else {
+			fmt.Printf("Warning: ignoring invalid STEP_MAX_MEMORY %q: %v\n", cfg.StepMaxMemory, err)
+		}
+	}
+	return limits
+}
+
+// ForStep applies the limits a step declares on top of the defaults
+func (l ResourceLimits) ForStep(step pipeline.Step) ResourceLimits {
+	if d, err := time.ParseDuration(step.Timeout); err == nil && step.Timeout != "" {
+		l.Timeout = d
+	}
+	if size, err := pipeline.ParseByteSize(step.MaxMemory); err == nil && step.MaxMemory != "" {
+		l.MaxMemory = size
+	}
+	if step.Nice != nil {
+		l.Nice = *step.Nice
+	}
+	if step.CPUWeight > 0 {
+		l.CPUWeight = step.CPUWeight
+	}
+	return l
+}
+
+// StepTimeoutError reports a step that was killed for exceeding its time limit
+type StepTimeoutError struct {
+	Step      int
+	Operation string
+	Timeout   time.Duration
+}
+
+func (e *StepTimeoutError) Error() string {
+	return fmt.Sprintf("timeout: step %d (%s) exceeded its %s limit", e.Step, e.Operation, e.Timeout)
+}
@@ -0,0 +1,129 @@
+//go:build linux
+
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// runWithLimits runs the command under the resource limits. Memory and CPU weight are
+// enforced with a cgroup v2 when a cgroup root is configured (the process is placed in it
+// atomically at fork); otherwise memory falls back to RLIMIT_AS. The rlimit and niceness
+// are set by starting the tool through prlimit and nice, so that they apply before the
+// tool runs.
+func runWithLimits(cmd *exec.Cmd, limits ResourceLimits) error {
+	cgroup, err := newStepCgroup(limits)
+	if err != nil {
+		fmt.Printf("Warning: cgroup limits unavailable, falling back to rlimits: %v\n", err)
+	}
+	if cgroup != nil {
+		defer cgroup.remove()
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = cgroup.fd
+	}
+
+	// Wrappers exec each other and then the tool, which inherits the limits along with
+	// the helpers it starts. The innermost wrapper is added first.
+	if cmd.Err == nil {
+		if limits.MaxMemory > 0 && cgroup == nil {
+			wrapCommand(cmd, "prlimit", fmt.Sprintf("--as=%d", limits.MaxMemory), "--")
+		}
+		if limits.Nice > 0 {
+			wrapCommand(cmd, "nice", "-n", strconv.Itoa(limits.Nice))
+		}
+	}
+
+	err = cmd.Run()
+	if err != nil && cgroup != nil && cgroup.oomKilled() {
+		return fmt.Errorf("memory limit of %d bytes exceeded: %w", limits.MaxMemory, err)
+	}
+	return err
+}
+
+// wrapCommand has the command started through a wrapper tool that execs it, such as nice.
+// If the wrapper isn't installed, the command is left as it is.
+func wrapCommand(cmd *exec.Cmd, wrapper string, args ...string) {
+	path, err := exec.LookPath(wrapper)
+	if err != nil {
+		fmt.Printf("Warning: %s not found, running %s without its limit: %v\n", wrapper, cmd.Path, err)
+		return
+	}
+	cmd.Args = slices.Concat([]string{wrapper}, args, []string{cmd.Path}, cmd.Args[1:])
+	cmd.Path = path
+}
+
+// stepCgroup is a cgroup v2 created for a single step
+type stepCgroup struct {
+	path string
+	fd   int
+}
+
+func newStepCgroup(limits ResourceLimits) (*stepCgroup, error) {
+	if limits.CgroupRoot == "" || (limits.MaxMemory == 0 && limits.CPUWeight == 0) {
+		return nil, nil
+	}
+
+	path, err := os.MkdirTemp(limits.CgroupRoot, "step-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	if limits.MaxMemory > 0 {
+		if err := os.WriteFile(filepath.Join(path, "memory.max"), []byte(strconv.FormatInt(limits.MaxMemory, 10)), 0644); err != nil {
+			os.Remove(path)
+			return nil, fmt.Errorf("failed to set memory.max: %w", err)
+		}
+		// Keep the limit strict instead of pushing the tool into swap
+		os.WriteFile(filepath.Join(path, "memory.swap.max"), []byte("0"), 0644)
+	}
+	if limits.CPUWeight > 0 {
+		if err := os.WriteFile(filepath.Join(path, "cpu.weight"), []byte(strconv.Itoa(limits.CPUWeight)), 0644); err != nil {
+			os.Remove(path)
+			return nil, fmt.Errorf("failed to set cpu.weight: %w", err)
+		}
+	}
+
+	fd, err := syscall.Open(path, syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+
+	return &stepCgroup{path: path, fd: fd}, nil
+}
+
+// oomKilled reports whether the kernel killed a process in the cgroup for exceeding memory.max
+func (c *stepCgroup) oomKilled() bool {
+	f, err := os.Open(filepath.Join(c.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return fields[1] != "0"
+		}
+	}
+	return false
+}
+
+func (c *stepCgroup) remove() {
+	syscall.Close(c.fd)
+	if err := os.Remove(c.path); err != nil {
+		fmt.Printf("Warning: failed to remove cgroup %s: %v\n", c.path, err)
+	}
+}
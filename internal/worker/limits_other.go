@@ -0,0 +1,11 @@
+//go:build !linux
+
+package worker
+
+import "os/exec"
+
+// runWithLimits runs the command. Memory, niceness and CPU weight limits are only
+// enforced on Linux; the step timeout still applies through the command's context.
+func runWithLimits(cmd *exec.Cmd, limits ResourceLimits) error {
+	return cmd.Run()
+}
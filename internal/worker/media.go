@@ -0,0 +1,110 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mukund/mediaconvert/internal/models"
+	"github.com/mukund/mediaconvert/internal/pipeline"
+)
+
+// ffprobeOutput is the part of ffprobe's JSON output describing an input
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// InputProperties describes a job's input for evaluating step conditions. The input is
+// only probed if a step has a condition; properties that can't be probed are left zero.
+func InputProperties(ctx context.Context, file models.File, path string, p *pipeline.Pipeline) pipeline.MediaProperties {
+	props := pipeline.MediaProperties{ContentType: file.ContentType, Size: file.Size}
+	if !slices.ContainsFunc(p.Steps, func(step pipeline.Step) bool { return step.When != "" }) {
+		return props
+	}
+
+	err := probeMedia(ctx, path, &props)
+	if err != nil && strings.HasPrefix(file.ContentType, "image/") {
+		err = identifyImage(ctx, path, &props)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to probe %s for step conditions: %v\n", path, err)
+	}
+	return props
+}
+
+// probeMedia fills in the dimensions, duration and codecs of a media file using ffprobe
+func probeMedia(ctx context.Context, path string, props *pipeline.MediaProperties) error {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "stream=codec_type,codec_name,width,height:format=duration",
+		"-of", "json",
+		path,
+	).Output()
+	if err != nil {
+		return err
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return fmt.Errorf("invalid ffprobe output: %w", err)
+	}
+
+	// Use the first stream of each type
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			if props.VideoCodec == "" {
+				props.VideoCodec = stream.CodecName
+				props.Width = stream.Width
+				props.Height = stream.Height
+			}
+		case "audio":
+			if props.AudioCodec == "" {
+				props.AudioCodec = stream.CodecName
+			}
+		}
+	}
+	if seconds, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		props.Duration = seconds
+	}
+	return nil
+}
+
+// identifyImage fills in the dimensions of an image using ImageMagick, for workers
+// without ffmpeg
+func identifyImage(ctx context.Context, path string, props *pipeline.MediaProperties) error {
+	out, err := exec.CommandContext(ctx, "identify", "-format", "%w %h", path+"[0]").Output()
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Sscanf(string(out), "%d %d", &props.Width, &props.Height); err != nil {
+		return fmt.Errorf("invalid identify output %q: %w", out, err)
+	}
+	return nil
+}
+
+// JobVariables returns the variables substituted in a job's steps: its parameter values as
+// params.<name>, and the built-in basename and ext (of the uploaded file's name), job_id
+// and user_id
+func JobVariables(job *models.Job, params map[string]interface{}) map[string]interface{} {
+	vars := pipeline.ParamVariables(params)
+	ext := filepath.Ext(job.File.OriginalName)
+	vars["basename"] = strings.TrimSuffix(job.File.OriginalName, ext)
+	vars["ext"] = strings.TrimPrefix(ext, ".")
+	vars["job_id"] = job.ID
+	vars["user_id"] = job.File.UserID
+	return vars
+}
@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// busyUsersRefresh is how long the users at their concurrency limit are cached for
+const busyUsersRefresh = 2 * time.Second
+
+// Pool runs jobs from the job queue on a bounded number of goroutines
+type Pool struct {
+	queue     Queue
+	processor *JobProcessor
+	consumer  string
+	queues    []string
+	caps      []string // Capabilities of the worker, limiting the jobs it takes
+	claimIdle time.Duration
+	grace     time.Duration // How long running jobs may take to finish on shutdown
+	slots     chan struct{}
+	wg        sync.WaitGroup
+
+	mu            sync.Mutex
+	busyUsers     map[uint]bool // Users at their concurrency limit, whose jobs are skipped
+	busyUsersTime time.Time
+}
+
+// NewPool creates a worker pool that processes up to size jobs at once from the given queues,
+// taking only jobs that the given capabilities allow it to run. On shutdown, running jobs get
+// the grace period to finish before they are stopped and re-queued.
+func NewPool(queue Queue, processor *JobProcessor, consumer string, queues, capabilities []string, size int, claimIdle, grace time.Duration) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{
+		queue:     queue,
+		processor: processor,
+		consumer:  consumer,
+		queues:    queues,
+		caps:      capabilities,
+		claimIdle: claimIdle,
+		grace:     grace,
+		slots:     make(chan struct{}, size),
+	}
+}
+
+// Run pulls jobs until ctx is cancelled, then drains the running jobs.
+// A job is only pulled from the queue once a slot is free, so jobs that can't
+// be started yet stay available to other workers.
+func (p *Pool) Run(ctx context.Context) {
+	for {
+		// Wait for a free slot
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			p.drain()
+			return
+		}
+
+		msg, ok := p.next(ctx)
+		if !ok {
+			<-p.slots
+			if ctx.Err() != nil {
+				p.drain()
+				return
+			}
+			continue
+		}
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() { <-p.slots }()
+			p.process(ctx, msg)
+		}()
+	}
+}
+
+// drain waits for running jobs to finish. Jobs still running after the grace period
+// are stopped and re-queued.
+func (p *Pool) drain() {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	default:
+	}
+	log.Printf("Draining: waiting up to %s for running jobs to finish", p.grace)
+
+	select {
+	case <-done:
+		return
+	case <-time.After(p.grace):
+	}
+
+	if n := p.processor.StopAll(); n > 0 {
+		log.Printf("Grace period over, stopping and re-queueing %d running jobs", n)
+	}
+	<-done
+}
+
+// next returns the highest-priority job available on the pool's queues, waiting
+// briefly before giving up if there is none
+func (p *Pool) next(ctx context.Context) (JobMessage, bool) {
+	filter := JobFilter{
+		Queues:       p.queues,
+		Capabilities: p.caps,
+		SkipUsers:    p.usersAtLimit(),
+	}
+	msg, err := p.queue.Dequeue(ctx, p.consumer, filter, p.claimIdle)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Failed to fetch next job: %v", err)
+	}
+	if msg != nil {
+		return *msg, true
+	}
+
+	p.queue.Wait(ctx)
+	return JobMessage{}, false
+}
+
+// process runs a job and acknowledges it, keeping its lease on the queue entry while it runs
+func (p *Pool) process(ctx context.Context, msg JobMessage) {
+	log.Printf("Received job: %d", msg.JobID)
+
+	// Keep the claim alive while the job drains after shutdown
+	ctx = context.WithoutCancel(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(p.claimIdle / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.queue.Extend(ctx, p.consumer, msg, p.claimIdle); err != nil {
+					log.Printf("Failed to refresh claim on job %d: %v", msg.JobID, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := p.processor.ProcessJob(msg.JobID)
+	close(done)
+
+	if errors.Is(err, errConcurrencyLimit) {
+		// The user reached their limit since it was last checked. Hold the job back
+		// without using up an attempt; other users' jobs go first meanwhile.
+		p.invalidateUsersAtLimit()
+		if err := p.queue.Nack(context.Background(), msg, concurrencyRetryDelay); err != nil {
+			log.Printf("Failed to hold back job %d: %v", msg.JobID, err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to process job %d: %v", msg.JobID, err)
+	}
+
+	if err := p.queue.Ack(context.Background(), msg); err != nil {
+		log.Printf("Failed to acknowledge job %d: %v", msg.JobID, err)
+	}
+}
+
+// usersAtLimit returns the users at their concurrency limit, refreshing them from the
+// database when the cached set is stale
+func (p *Pool) usersAtLimit() map[uint]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.busyUsers != nil && time.Since(p.busyUsersTime) < busyUsersRefresh {
+		return p.busyUsers
+	}
+
+	busy, err := p.processor.UsersAtConcurrencyLimit()
+	if err != nil {
+		// Jobs of users at their limit are still held back when claimed
+		log.Printf("Failed to check user concurrency limits: %v", err)
+		return p.busyUsers
+	}
+	p.busyUsers = busy
+	p.busyUsersTime = time.Now()
+	return busy
+}
+
+func (p *Pool) invalidateUsersAtLimit() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.busyUsers = nil
+}
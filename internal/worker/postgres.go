@@ -0,0 +1,334 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/mukund/mediaconvert/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// pgJobsChannel is notified when jobs are enqueued, waking up idle workers
+	pgJobsChannel = "jobs_enqueued"
+	// pgCancelChannel carries the IDs of jobs to stop
+	pgCancelChannel = "job_cancel"
+
+	// pgPollInterval is how long an idle worker waits for a notification before it looks
+	// for jobs again, e.g. for delayed jobs becoming due
+	pgPollInterval = 5 * time.Second
+	// pgReconnectDelay is how long a listener waits before reconnecting after an error
+	pgReconnectDelay = 2 * time.Second
+)
+
+// PostgresQueue is a Queue on a PostgreSQL table. Workers lease entries with
+// SELECT ... FOR UPDATE SKIP LOCKED and are woken up with LISTEN/NOTIFY.
+type PostgresQueue struct {
+	db  *gorm.DB
+	dsn string // For the dedicated connections LISTEN needs
+
+	mu       sync.Mutex
+	lastUser uint          // User whose job was dequeued last, so users take turns
+	wake     chan struct{} // Closed and replaced when jobs are enqueued
+	listen   sync.Once
+	stop     context.CancelFunc
+}
+
+// NewPostgresQueue creates a queue on the given database. dsn is used to open the
+// connections that listen for notifications.
+func NewPostgresQueue(db *gorm.DB, dsn string) (*PostgresQueue, error) {
+	if err := db.Exec("SELECT 1").Error; err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	return &PostgresQueue{
+		db:   db,
+		dsn:  dsn,
+		wake: make(chan struct{}),
+		stop: func() {},
+	}, nil
+}
+
+// Enqueue adds a job to the queue and wakes up idle workers
+func (q *PostgresQueue) Enqueue(job *models.Job) error {
+	if err := q.insert(job, time.Now()); err != nil {
+		return err
+	}
+	return q.db.Exec("SELECT pg_notify(?, ?)", pgJobsChannel, job.Queue).Error
+}
+
+// EnqueueAt adds a job to the queue that is handed out once at is reached
+func (q *PostgresQueue) EnqueueAt(job *models.Job, at time.Time) error {
+	return q.insert(job, at)
+}
+
+func (q *PostgresQueue) insert(job *models.Job, at time.Time) error {
+	queue := job.Queue
+	if queue == "" {
+		queue = models.DefaultJobQueue
+	}
+	return q.db.Create(&models.QueuedJob{
+		JobID:        job.ID,
+		Queue:        queue,
+		Priority:     job.Priority,
+		UserID:       job.File.UserID,
+		Capabilities: job.Capabilities,
+		AvailableAt:  at,
+	}).Error
+}
+
+// Dequeue leases the highest-priority job the consumer may take under the given filter.
+// Among jobs of the same priority, users take turns: the users after the one whose job
+// this worker dequeued last come first.
+func (q *PostgresQueue) Dequeue(ctx context.Context, consumer string, filter JobFilter, lease time.Duration) (*JobMessage, error) {
+	q.mu.Lock()
+	lastUser := q.lastUser
+	q.mu.Unlock()
+
+	now := time.Now()
+	candidates := q.db.WithContext(ctx).Model(&models.QueuedJob{}).
+		Select("id").
+		Where("queue IN ? AND available_at <= ?", filter.Queues, now).
+		Where("(lease_expires_at IS NULL OR lease_expires_at < ?)", now).
+		// Capabilities never contain commas, so the lists can be compared as arrays
+		Where("string_to_array(capabilities, ',') <@ string_to_array(?, ',')", strings.Join(filter.Capabilities, ","))
+	if len(filter.SkipUsers) > 0 {
+		skip := make([]uint, 0, len(filter.SkipUsers))
+		for userID := range filter.SkipUsers {
+			skip = append(skip, userID)
+		}
+		candidates = candidates.Where("user_id NOT IN ?", skip)
+	}
+	candidates = candidates.
+		Order(clause.OrderBy{Expression: clause.Expr{
+			SQL:  "priority DESC, user_id <= ?, user_id, id",
+			Vars: []interface{}{lastUser},
+		}}).
+		Limit(1).
+		Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+
+	var entry models.QueuedJob
+	result := q.db.WithContext(ctx).Raw(
+		"UPDATE queued_jobs SET lease_owner = ?, lease_expires_at = ? WHERE id = (?) RETURNING id, job_id, user_id",
+		consumer, now.Add(lease), candidates,
+	).Scan(&entry)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	q.mu.Lock()
+	q.lastUser = entry.UserID
+	q.mu.Unlock()
+
+	return &JobMessage{ID: strconv.FormatUint(entry.ID, 10), JobID: entry.JobID}, nil
+}
+
+// Extend renews the consumer's lease on a dequeued job
+func (q *PostgresQueue) Extend(ctx context.Context, consumer string, msg JobMessage, lease time.Duration) error {
+	id, err := entryID(msg)
+	if err != nil {
+		return err
+	}
+	return q.db.WithContext(ctx).Model(&models.QueuedJob{}).
+		Where("id = ? AND lease_owner = ?", id, consumer).
+		Update("lease_expires_at", time.Now().Add(lease)).Error
+}
+
+// Ack removes a dequeued job from the queue
+func (q *PostgresQueue) Ack(ctx context.Context, msg JobMessage) error {
+	id, err := entryID(msg)
+	if err != nil {
+		return err
+	}
+	return q.db.WithContext(ctx).Delete(&models.QueuedJob{}, "id = ?", id).Error
+}
+
+// Nack releases the lease on a dequeued job, which is handed out again after delay
+func (q *PostgresQueue) Nack(ctx context.Context, msg JobMessage, delay time.Duration) error {
+	id, err := entryID(msg)
+	if err != nil {
+		return err
+	}
+	return q.db.WithContext(ctx).Model(&models.QueuedJob{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"lease_owner":      "",
+			"lease_expires_at": nil,
+			"available_at":     time.Now().Add(delay),
+		}).Error
+}
+
+func entryID(msg JobMessage) (uint64, error) {
+	id, err := strconv.ParseUint(msg.ID, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid queue entry ID %q: %w", msg.ID, err)
+	}
+	return id, nil
+}
+
+// Wait blocks until a job is enqueued, or for the poll interval at most
+func (q *PostgresQueue) Wait(ctx context.Context) {
+	q.listen.Do(func() {
+		listenCtx, stop := context.WithCancel(context.Background())
+		q.mu.Lock()
+		q.stop = stop
+		q.mu.Unlock()
+		go q.listenFor(listenCtx, pgJobsChannel, func(string) { q.wakeWaiters() })
+	})
+
+	q.mu.Lock()
+	wake := q.wake
+	q.mu.Unlock()
+
+	select {
+	case <-wake:
+	case <-time.After(pgPollInterval):
+	case <-ctx.Done():
+	}
+}
+
+func (q *PostgresQueue) wakeWaiters() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// Maintain has nothing to do: delayed jobs and expired leases are picked up by Dequeue
+func (q *PostgresQueue) Maintain(ctx context.Context) error {
+	return nil
+}
+
+// QueuedJobIDs returns the IDs of the jobs with an entry in the queue table
+func (q *PostgresQueue) QueuedJobIDs(ctx context.Context) (map[uint]bool, error) {
+	var jobIDs []uint
+	if err := q.db.WithContext(ctx).Model(&models.QueuedJob{}).Distinct().Pluck("job_id", &jobIDs).Error; err != nil {
+		return nil, err
+	}
+	ids := make(map[uint]bool, len(jobIDs))
+	for _, id := range jobIDs {
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// PublishJobCancel tells the worker running a job to stop it
+func (q *PostgresQueue) PublishJobCancel(jobID uint) error {
+	return q.db.Exec("SELECT pg_notify(?, ?)", pgCancelChannel, strconv.FormatUint(uint64(jobID), 10)).Error
+}
+
+// JobCancellations delivers the jobs to stop until ctx is cancelled
+func (q *PostgresQueue) JobCancellations(ctx context.Context) (<-chan uint, error) {
+	jobIDs := make(chan uint)
+	go func() {
+		defer close(jobIDs)
+		q.listenFor(ctx, pgCancelChannel, func(payload string) {
+			if jobID, ok := parseJobCancel(payload); ok {
+				select {
+				case jobIDs <- jobID:
+				case <-ctx.Done():
+				}
+			}
+		})
+	}()
+	return jobIDs, nil
+}
+
+// listenFor calls handle with the payload of every notification on channel until ctx is
+// cancelled, reconnecting when the connection fails
+func (q *PostgresQueue) listenFor(ctx context.Context, channel string, handle func(payload string)) {
+	for ctx.Err() == nil {
+		err := q.listenOnce(ctx, channel, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Lost PostgreSQL listener on %s, reconnecting: %v", channel, err)
+
+		select {
+		case <-time.After(pgReconnectDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (q *PostgresQueue) listenOnce(ctx context.Context, channel string, handle func(payload string)) error {
+	conn, err := pgx.Connect(ctx, q.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		handle(notification.Payload)
+	}
+}
+
+// RegisterWorker stores a worker's registration for ttl
+func (q *PostgresQueue) RegisterWorker(ctx context.Context, info WorkerInfo, ttl time.Duration) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return q.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&models.WorkerRegistration{
+		ID:        info.ID,
+		Info:      data,
+		LastSeen:  info.LastSeen,
+		ExpiresAt: info.LastSeen.Add(ttl),
+	}).Error
+}
+
+// UnregisterWorker removes a worker's registration
+func (q *PostgresQueue) UnregisterWorker(ctx context.Context, id string) error {
+	return q.db.WithContext(ctx).Delete(&models.WorkerRegistration{}, "id = ?", id).Error
+}
+
+// ListWorkers returns the live workers, most recently seen first. Expired registrations
+// are deleted.
+func (q *PostgresQueue) ListWorkers(ctx context.Context) ([]WorkerInfo, error) {
+	now := time.Now()
+	if err := q.db.WithContext(ctx).Delete(&models.WorkerRegistration{}, "expires_at < ?", now).Error; err != nil {
+		return nil, err
+	}
+
+	var registrations []models.WorkerRegistration
+	if err := q.db.WithContext(ctx).Order("last_seen DESC").Find(&registrations).Error; err != nil {
+		return nil, err
+	}
+
+	workers := []WorkerInfo{}
+	for _, registration := range registrations {
+		var info WorkerInfo
+		if err := json.Unmarshal(registration.Info, &info); err != nil {
+			return nil, fmt.Errorf("invalid registration of worker %s: %w", registration.ID, err)
+		}
+		workers = append(workers, info)
+	}
+	return workers, nil
+}
+
+// Close stops listening for enqueued jobs. The database connection is left open for
+// its other users.
+func (q *PostgresQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stop()
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package worker
+
+import "os/exec"
+
+// setProcessGroup is a no-op on platforms without process groups; the command
+// itself is still killed on cancellation
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -3,9 +3,12 @@ package worker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -13,26 +16,36 @@ import (
 	"github.com/mukund/mediaconvert/internal/config"
 	"github.com/mukund/mediaconvert/internal/models"
 	"github.com/mukund/mediaconvert/internal/pipeline"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
+// ErrWorkerShutdown is the cause given to jobs stopped because the worker is shutting down
+var ErrWorkerShutdown = errors.New("worker shutting down")
+
 // JobProcessor handles job processing
 type JobProcessor struct {
 	db          *gorm.DB
 	minioClient *minio.Client
 	config      *config.Config
-	redis       *RedisClient
+	queue       Queue
+	canceller   Canceller
 	analytics   *analytics.Client
+
+	mu      sync.Mutex
+	running map[uint]context.CancelCauseFunc // Cancel functions of jobs running on this worker
 }
 
 // NewJobProcessor creates a new job processor
-func NewJobProcessor(db *gorm.DB, minioClient *minio.Client, cfg *config.Config, redis *RedisClient, analyticsClient *analytics.Client) *JobProcessor {
+func NewJobProcessor(db *gorm.DB, minioClient *minio.Client, cfg *config.Config, queue Queue, canceller Canceller, analyticsClient *analytics.Client) *JobProcessor {
 	return &JobProcessor{
 		db:          db,
 		minioClient: minioClient,
 		config:      cfg,
-		redis:       redis,
+		queue:       queue,
+		canceller:   canceller,
 		analytics:   analyticsClient,
+		running:     make(map[uint]context.CancelCauseFunc),
 	}
 }
 
@@ -43,14 +56,67 @@ func (p *JobProcessor) ProcessJob(jobID uint) error {
 
 	// Load job with relationships
 	var job models.Job
-	if err := p.db.Preload("File").Preload("Pipeline").First(&job, jobID).Error; err != nil {
+	if err := p.db.Preload("File").Preload("Pipeline").Preload("PipelineVersion").First(&job, jobID).Error; err != nil {
 		return fmt.Errorf("failed to load job: %w", err)
 	}
 
-	// Update status to processing
+	// Skip jobs that already reached a final state (e.g. redelivered after a worker crash)
+	if job.Status != models.JobStatusPending && job.Status != models.JobStatusProcessing && job.Status != models.JobStatusRetrying {
+		fmt.Printf("Skipping job %d with status %s\n", job.ID, job.Status)
+		return nil
+	}
+
+	// Don't start jobs that are no longer useful
+	if job.ExpiresAt != nil && time.Now().After(*job.ExpiresAt) {
+		if _, err := expireJob(ctx, p.db, p.analytics, p.canceller, &job); err != nil {
+			return fmt.Errorf("failed to expire job: %w", err)
+		}
+		fmt.Printf("Skipping job %d: expired at %s\n", job.ID, job.ExpiresAt.Format(time.RFC3339))
+		return nil
+	}
+
+	// Take the job's lease and mark it processing. This only succeeds if the job is
+	// still waiting, or if the worker previously processing it let its lease expire.
+	previousStatus := job.Status
+	now := time.Now()
+	leaseExpiresAt := now.Add(p.config.JobLeaseDuration)
+	var claimed int64
+	err := claimWithinLimit(p.db, p.config, job.File.UserID, job.ID, now, func(tx *gorm.DB) error {
+		result := tx.Model(&models.Job{}).
+			Where("id = ?", job.ID).
+			Where("(status IN ? OR (status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?)))",
+				[]models.JobStatus{models.JobStatusPending, models.JobStatusRetrying}, models.JobStatusProcessing, now).
+			Updates(map[string]interface{}{
+				"status":           models.JobStatusProcessing,
+				"attempts":         gorm.Expr("attempts + 1"),
+				"lease_owner":      p.config.WorkerID,
+				"lease_expires_at": leaseExpiresAt,
+				"worker_id":        p.config.WorkerID,
+				"progress":         nil, // Clear progress and logs left by a previous attempt
+				"result_info":      nil,
+			})
+		claimed = result.RowsAffected
+		return result.Error
+	})
+	if errors.Is(err, errConcurrencyLimit) {
+		// The caller holds the job back without using up an attempt
+		fmt.Printf("Holding back job %d: user %d is at their concurrency limit\n", job.ID, job.File.UserID)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update job status: %w", err)
+	}
+	if claimed == 0 {
+		fmt.Printf("Skipping job %d: already taken or no longer pending\n", job.ID)
+		return nil
+	}
 	job.Status = models.JobStatusProcessing
-	p.db.Save(&job)
-	recordStatusChange(p.db, job.ID, models.JobStatusPending, models.JobStatusProcessing, "Worker started processing", "worker")
+	job.Attempts++
+	job.LeaseOwner = p.config.WorkerID
+	job.WorkerID = p.config.WorkerID
+	job.LeaseExpiresAt = &leaseExpiresAt
+	job.ResultInfo = nil
+	recordStatusChange(p.db, job.ID, previousStatus, models.JobStatusProcessing, fmt.Sprintf("Worker started processing (attempt %d)", job.Attempts), "worker")
 
 	// Record status transition in analytics
 	if p.analytics != nil {
@@ -58,68 +124,110 @@ func (p *JobProcessor) ProcessJob(jobID uint) error {
 			Timestamp:   time.Now(),
 			JobID:       uint64(job.ID),
 			UserID:      uint64(job.File.UserID),
-			FromStatus:  string(models.JobStatusPending),
+			FromStatus:  string(previousStatus),
 			ToStatus:    string(models.JobStatusProcessing),
 			TriggeredBy: "worker",
-			Message:     "Worker started processing",
+			Message:     fmt.Sprintf("Worker started processing (attempt %d)", job.Attempts),
 		})
 	}
 
-	// Create work directory
-	workDir := filepath.Join(os.TempDir(), fmt.Sprintf("job-%d", job.ID))
-	if err := os.MkdirAll(workDir, 0755); err != nil {
-		return p.failJob(&job, fmt.Errorf("failed to create work directory: %w", err))
-	}
-	defer os.RemoveAll(workDir) // Cleanup
+	// Register the job so a cancel signal can stop it
+	jobCtx, cancelJob := context.WithCancelCause(context.Background())
+	defer cancelJob(nil)
+	p.trackRunning(job.ID, cancelJob)
+	defer p.untrackRunning(job.ID)
 
-	// Download input file from S3
-	inputFile := filepath.Join(workDir, "input"+filepath.Ext(job.File.OriginalName))
-	if err := p.downloadFile(job.File.S3Key, inputFile); err != nil {
-		return p.failJob(&job, fmt.Errorf("failed to download file: %w", err))
-	}
+	// Keep the lease alive while the job runs
+	go p.renewLease(jobCtx, func() { cancelJob(nil) }, job.ID)
 
 	// Parse pipeline
 	var pipelineObj *pipeline.Pipeline
-	var err error
-	if job.Pipeline != nil {
-		if job.Pipeline.Format == models.PipelineFormatYAML {
-			pipelineObj, err = pipeline.ParseYAML([]byte(job.Pipeline.Content))
-		} else {
-			pipelineObj, err = pipeline.ParseJSON([]byte(job.Pipeline.Content))
-		}
-		if err != nil {
-			return p.failJob(&job, fmt.Errorf("failed to parse pipeline: %w", err))
+	policy := DefaultRetryPolicy(p.config)
+	if job.PipelineVersion == nil && job.Pipeline == nil {
+		return p.failJob(jobCtx, &job, policy, fmt.Errorf("no pipeline specified"))
+	}
+	pipelineObj, err = jobPipeline(&job)
+	if err != nil {
+		return p.failJob(jobCtx, &job, policy, fmt.Errorf("failed to parse pipeline: %w", err))
+	}
+	policy = policy.WithOverrides(pipelineObj.Retry)
+	// Pipelines are validated when saved, but may have been saved before a check was added
+	if err := pipelineObj.Validate(); err != nil {
+		return p.failJob(jobCtx, &job, policy, fmt.Errorf("invalid pipeline: %w", err))
+	}
+
+	// Resolve the parameters again, for defaults added since the job was submitted
+	var supplied map[string]interface{}
+	if len(job.Params) > 0 {
+		if err := json.Unmarshal(job.Params, &supplied); err != nil {
+			return p.failJob(jobCtx, &job, policy, fmt.Errorf("invalid job parameters: %w", err))
 		}
-	} else {
-		return p.failJob(&job, fmt.Errorf("no pipeline specified"))
+	}
+	params, err := pipelineObj.ResolveParams(supplied)
+	if err != nil {
+		return p.failJob(jobCtx, &job, policy, fmt.Errorf("invalid job parameters: %w", err))
+	}
+
+	// Create a private work directory so concurrent jobs never share files
+	workDir, err := os.MkdirTemp("", fmt.Sprintf("job-%d-", job.ID))
+	if err != nil {
+		return p.failJob(jobCtx, &job, policy, retryable(fmt.Errorf("failed to create work directory: %w", err)))
+	}
+	defer os.RemoveAll(workDir) // Cleanup
+
+	// Download input file from S3
+	inputFile := filepath.Join(workDir, "input"+filepath.Ext(job.File.OriginalName))
+	if err := p.downloadFile(jobCtx, job.File.S3Key, inputFile); err != nil {
+		return p.failJob(jobCtx, &job, policy, retryable(fmt.Errorf("failed to download file: %w", err)))
 	}
 
 	// Execute pipeline
-	outputFiles, err := ExecutePipeline(pipelineObj, inputFile, workDir)
+	input := PipelineInput{
+		Path:       inputFile,
+		Properties: InputProperties(jobCtx, job.File, inputFile, pipelineObj),
+		Variables:  JobVariables(&job, params),
+	}
+	outputFiles, skippedSteps, err := ExecutePipeline(jobCtx, pipelineObj, input, workDir, DefaultResourceLimits(p.config), p.config.MaxParallelSteps, p.progressReporter(job.ID))
+	stepLogs := p.uploadLogs(jobCtx, job.File.UserID, job.ID, workDir, pipelineObj.Steps)
 	if err != nil {
-		return p.failJob(&job, fmt.Errorf("pipeline execution failed: %w", err))
+		job.ResultInfo, _ = json.Marshal(map[string]interface{}{"logs": stepLogs, "skipped_steps": skippedSteps})
+		// Report timeouts as-is so the job error starts with a clear "timeout" reason
+		var timeoutErr *StepTimeoutError
+		if errors.As(err, &timeoutErr) {
+			return p.failJob(jobCtx, &job, policy, err)
+		}
+		return p.failJob(jobCtx, &job, policy, fmt.Errorf("pipeline execution failed: %w", err))
 	}
 
 	// Upload results to S3
-	resultPaths, err := p.uploadResults(job.File.UserID, job.ID, outputFiles)
+	resultPaths, err := p.uploadResults(jobCtx, job.File.UserID, job.ID, outputFiles)
 	if err != nil {
-		return p.failJob(&job, fmt.Errorf("failed to upload results: %w", err))
+		return p.failJob(jobCtx, &job, policy, retryable(fmt.Errorf("failed to upload results: %w", err)))
 	}
 
 	// Update job as completed
-	now := time.Now()
+	now = time.Now()
 	job.Status = models.JobStatusCompleted
 	job.FinishedAt = &now
 
 	// Convert result info to JSON
 	resultData := map[string]interface{}{
-		"output_files": resultPaths,
-		"processed_at": now,
+		"output_files":  resultPaths,
+		"logs":          stepLogs,
+		"skipped_steps": skippedSteps,
+		"processed_at":  now,
 	}
 	resultJSON, _ := json.Marshal(resultData)
 	job.ResultInfo = resultJSON
 
-	p.db.Save(&job)
+	if !p.updateIfProcessing(job.ID, map[string]interface{}{
+		"status":      job.Status,
+		"finished_at": job.FinishedAt,
+		"result_info": job.ResultInfo,
+	}) {
+		fmt.Printf("Job %d was canceled, discarding results\n", job.ID)
+		return nil
+	}
 	recordStatusChange(p.db, job.ID, models.JobStatusProcessing, models.JobStatusCompleted, "Job completed successfully", "worker")
 
 	// Record metrics and status transition in analytics
@@ -163,11 +271,11 @@ func (p *JobProcessor) ProcessJob(jobID uint) error {
 	return nil
 }
 
-func (p *JobProcessor) downloadFile(s3Key, destPath string) error {
-	return p.minioClient.FGetObject(context.Background(), p.config.S3Bucket, s3Key, destPath, minio.GetObjectOptions{})
+func (p *JobProcessor) downloadFile(ctx context.Context, s3Key, destPath string) error {
+	return p.minioClient.FGetObject(ctx, p.config.S3Bucket, s3Key, destPath, minio.GetObjectOptions{})
 }
 
-func (p *JobProcessor) uploadResults(userID, jobID uint, files []string) ([]string, error) {
+func (p *JobProcessor) uploadResults(ctx context.Context, userID, jobID uint, files []string) ([]string, error) {
 	var s3Keys []string
 
 	for _, filePath := range files {
@@ -176,7 +284,7 @@ func (p *JobProcessor) uploadResults(userID, jobID uint, files []string) ([]stri
 		s3Key := fmt.Sprintf("users/%d/results/job-%d/%s", userID, jobID, fileName)
 
 		// Upload to S3
-		_, err := p.minioClient.FPutObject(context.Background(), p.config.S3Bucket, s3Key, filePath, minio.PutObjectOptions{})
+		_, err := p.minioClient.FPutObject(ctx, p.config.S3Bucket, s3Key, filePath, minio.PutObjectOptions{})
 		if err != nil {
 			return nil, err
 		}
@@ -187,13 +295,73 @@ func (p *JobProcessor) uploadResults(userID, jobID uint, files []string) ([]stri
 	return s3Keys, nil
 }
 
-func (p *JobProcessor) failJob(job *models.Job, err error) error {
+// StepLog describes an uploaded step log, as indexed in a job's result info
+type StepLog struct {
+	Step      int    `json:"step"`
+	Operation string `json:"operation"`
+	S3Key     string `json:"s3_key"`
+	Size      int64  `json:"size"`
+}
+
+// uploadLogs uploads the logs of the steps that ran. Failing to upload a log doesn't fail the job.
+func (p *JobProcessor) uploadLogs(ctx context.Context, userID, jobID uint, workDir string, steps []pipeline.Step) []StepLog {
+	logs := []StepLog{}
+
+	for i, step := range steps {
+		name := StepLogName(i + 1)
+		logPath := filepath.Join(StepLogsDir(workDir), name)
+		info, err := os.Stat(logPath)
+		if err != nil {
+			continue // The step didn't run
+		}
+
+		s3Key := fmt.Sprintf("users/%d/results/job-%d/logs/%s", userID, jobID, name)
+		_, err = p.minioClient.FPutObject(ctx, p.config.S3Bucket, s3Key, logPath, minio.PutObjectOptions{
+			ContentType: "text/plain; charset=utf-8",
+		})
+		if err != nil {
+			fmt.Printf("Failed to upload log of step %d for job %d: %v\n", i+1, jobID, err)
+			continue
+		}
+
+		logs = append(logs, StepLog{Step: i + 1, Operation: step.Operation, S3Key: s3Key, Size: info.Size()})
+	}
+
+	return logs
+}
+
+// failJob marks a job as failed, or schedules another attempt if the error is
+// transient and the retry policy allows it. Jobs that ran out of attempts on a transient
+// error are dead-lettered, and jobs stopped by a worker shutdown are re-queued.
+func (p *JobProcessor) failJob(jobCtx context.Context, job *models.Job, policy RetryPolicy, err error) error {
+	if errors.Is(context.Cause(jobCtx), ErrWorkerShutdown) {
+		return p.requeueOnShutdown(job, err)
+	}
+	if IsRetryable(err) {
+		if job.Attempts < policy.MaxAttempts {
+			return p.retryJob(job, policy.Delay(job.Attempts), err)
+		}
+		return p.deadLetterJob(job, err)
+	}
+
 	ctx := context.Background()
 	now := time.Now()
 	job.Status = models.JobStatusFailed
 	job.Error = err.Error()
 	job.FinishedAt = &now
-	p.db.Save(job)
+	updates := map[string]interface{}{
+		"status":      job.Status,
+		"error":       job.Error,
+		"finished_at": job.FinishedAt,
+	}
+	if len(job.ResultInfo) > 0 {
+		updates["result_info"] = job.ResultInfo
+	}
+	if !p.updateIfProcessing(job.ID, updates) {
+		// The job was cancelled while running; keep the canceled status
+		fmt.Printf("Job %d was canceled: %v\n", job.ID, err)
+		return nil
+	}
 	recordStatusChange(p.db, job.ID, models.JobStatusProcessing, models.JobStatusFailed, err.Error(), "worker")
 
 	// Record metrics and status transition in analytics
@@ -236,6 +404,224 @@ func (p *JobProcessor) failJob(job *models.Job, err error) error {
 	return err
 }
 
+// retryJob puts a job in the retrying state and schedules it to be enqueued again after delay
+func (p *JobProcessor) retryJob(job *models.Job, delay time.Duration, err error) error {
+	job.Status = models.JobStatusRetrying
+	job.Error = err.Error()
+	updates := map[string]interface{}{
+		"status": job.Status,
+		"error":  job.Error,
+	}
+	if len(job.ResultInfo) > 0 {
+		updates["result_info"] = job.ResultInfo
+	}
+	if !p.updateIfProcessing(job.ID, updates) {
+		fmt.Printf("Job %d was canceled: %v\n", job.ID, err)
+		return nil
+	}
+
+	message := fmt.Sprintf("Attempt %d failed, retrying in %s: %v", job.Attempts, delay.Round(time.Second), err)
+	recordStatusChange(p.db, job.ID, models.JobStatusProcessing, models.JobStatusRetrying, message, "worker")
+
+	if p.analytics != nil {
+		p.analytics.RecordJobStatusTransition(context.Background(), analytics.JobStatusTransition{
+			Timestamp:   time.Now(),
+			JobID:       uint64(job.ID),
+			UserID:      uint64(job.File.UserID),
+			FromStatus:  string(models.JobStatusProcessing),
+			ToStatus:    string(models.JobStatusRetrying),
+			TriggeredBy: "worker",
+			Message:     message,
+		})
+	}
+
+	if err := p.queue.EnqueueAt(job, time.Now().Add(delay)); err != nil {
+		return fmt.Errorf("failed to schedule retry: %w", err)
+	}
+
+	return err
+}
+
+// deadLetterJob moves a job that exhausted its retries to the dead-letter list
+func (p *JobProcessor) deadLetterJob(job *models.Job, err error) error {
+	now := time.Now()
+	job.Status = models.JobStatusDeadLettered
+	job.Error = err.Error()
+	job.DeadLetteredAt = &now
+	updates := map[string]interface{}{
+		"status":           job.Status,
+		"error":            job.Error,
+		"dead_lettered_at": job.DeadLetteredAt,
+	}
+	if len(job.ResultInfo) > 0 {
+		updates["result_info"] = job.ResultInfo
+	}
+	if !p.updateIfProcessing(job.ID, updates) {
+		fmt.Printf("Job %d was canceled: %v\n", job.ID, err)
+		return nil
+	}
+
+	message := fmt.Sprintf("Dead-lettered after %d attempts: %v", job.Attempts, err)
+	recordTransition(context.Background(), p.db, p.analytics, job, models.JobStatusProcessing, models.JobStatusDeadLettered, message, "worker")
+
+	return err
+}
+
+// requeueOnShutdown returns a job that was stopped because the worker is shutting down to
+// the queue. The interrupted attempt doesn't count towards the retry limit.
+func (p *JobProcessor) requeueOnShutdown(job *models.Job, err error) error {
+	if !p.updateIfProcessing(job.ID, map[string]interface{}{
+		"status":   models.JobStatusPending,
+		"attempts": gorm.Expr("attempts - 1"),
+	}) {
+		fmt.Printf("Job %d was canceled: %v\n", job.ID, err)
+		return nil
+	}
+	job.Status = models.JobStatusPending
+	job.Attempts--
+
+	recordTransition(context.Background(), p.db, p.analytics, job, models.JobStatusProcessing, models.JobStatusPending, "Requeued on shutdown", "worker")
+
+	if err := p.queue.Enqueue(job); err != nil {
+		// The reaper's pending sweep picks the job up when a worker starts
+		return fmt.Errorf("failed to requeue job on shutdown: %w", err)
+	}
+	fmt.Printf("Requeued job %d on shutdown\n", job.ID)
+	return nil
+}
+
+// updateIfProcessing applies updates and releases the lease only while the job is still
+// processing under this worker's lease, so a concurrent cancellation or a takeover by
+// another worker is never overwritten. It reports whether the job was updated.
+func (p *JobProcessor) updateIfProcessing(jobID uint, updates map[string]interface{}) bool {
+	updates["lease_owner"] = ""
+	updates["lease_expires_at"] = nil
+	result := p.db.Model(&models.Job{}).
+		Where("id = ? AND status = ? AND lease_owner = ?", jobID, models.JobStatusProcessing, p.config.WorkerID).
+		Updates(updates)
+	if result.Error != nil {
+		fmt.Printf("Failed to update job %d: %v\n", jobID, result.Error)
+		return false
+	}
+	return result.RowsAffected > 0
+}
+
+// progressInterval limits how often a running step's progress is written to the database
+const progressInterval = 2 * time.Second
+
+// progressReporter returns a ProgressFunc that stores progress on the job while it is
+// processing under this worker's lease. Updates within a step are throttled; step
+// starts are always stored.
+func (p *JobProcessor) progressReporter(jobID uint) ProgressFunc {
+	var lastSaved time.Time
+
+	return func(progress models.JobProgress) {
+		if progress.StepPercent != nil && progress.Percent < 100 && time.Since(lastSaved) < progressInterval {
+			return
+		}
+		lastSaved = time.Now()
+
+		data, _ := json.Marshal(progress)
+		err := p.db.Model(&models.Job{}).
+			Where("id = ? AND status = ? AND lease_owner = ?", jobID, models.JobStatusProcessing, p.config.WorkerID).
+			Update("progress", datatypes.JSON(data)).Error
+		if err != nil {
+			fmt.Printf("Failed to update progress of job %d: %v\n", jobID, err)
+		}
+	}
+}
+
+// renewLease extends the job's lease until ctx is done. If the lease was lost (the job
+// was cancelled or reclaimed by the reaper) the job is stopped.
+func (p *JobProcessor) renewLease(ctx context.Context, stop context.CancelFunc, jobID uint) {
+	ticker := time.NewTicker(p.config.JobLeaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result := p.db.Model(&models.Job{}).
+				Where("id = ? AND status = ? AND lease_owner = ?", jobID, models.JobStatusProcessing, p.config.WorkerID).
+				Update("lease_expires_at", time.Now().Add(p.config.JobLeaseDuration))
+			if result.Error != nil {
+				fmt.Printf("Failed to renew lease on job %d: %v\n", jobID, result.Error)
+				continue
+			}
+			if result.RowsAffected == 0 {
+				fmt.Printf("Lost lease on job %d, stopping\n", jobID)
+				stop()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RunningJobs returns the IDs of the jobs running on this worker
+func (p *JobProcessor) RunningJobs() []uint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	jobs := make([]uint, 0, len(p.running))
+	for id := range p.running {
+		jobs = append(jobs, id)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i] < jobs[j] })
+	return jobs
+}
+
+// CancelJob stops a job if it is running on this worker
+func (p *JobProcessor) CancelJob(jobID uint) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cancel, ok := p.running[jobID]
+	if ok {
+		cancel(nil)
+	}
+	return ok
+}
+
+// StopAll stops every job running on this worker so that it is re-queued, and returns
+// how many were stopped. It is used when the shutdown grace period runs out.
+func (p *JobProcessor) StopAll() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, cancel := range p.running {
+		cancel(ErrWorkerShutdown)
+	}
+	return len(p.running)
+}
+
+// ListenForCancellations stops running jobs when a cancel signal is published
+func (p *JobProcessor) ListenForCancellations(ctx context.Context) {
+	jobIDs, err := p.canceller.JobCancellations(ctx)
+	if err != nil {
+		fmt.Printf("Failed to listen for job cancellations: %v\n", err)
+		return
+	}
+
+	for jobID := range jobIDs {
+		if p.CancelJob(jobID) {
+			fmt.Printf("Cancelling job %d\n", jobID)
+		}
+	}
+}
+
+func (p *JobProcessor) trackRunning(jobID uint, cancel context.CancelCauseFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running[jobID] = cancel
+}
+
+func (p *JobProcessor) untrackRunning(jobID uint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.running, jobID)
+}
+
 func recordStatusChange(db *gorm.DB, jobID uint, fromStatus, toStatus models.JobStatus, message, triggeredBy string) {
 	history := models.JobStatusHistory{
 		JobID:       jobID,
@@ -246,3 +632,20 @@ func recordStatusChange(db *gorm.DB, jobID uint, fromStatus, toStatus models.Job
 	}
 	db.Create(&history)
 }
+
+// recordTransition records a status change in the job history and, when enabled, in analytics
+func recordTransition(ctx context.Context, db *gorm.DB, analyticsClient *analytics.Client, job *models.Job, fromStatus, toStatus models.JobStatus, message, triggeredBy string) {
+	recordStatusChange(db, job.ID, fromStatus, toStatus, message, triggeredBy)
+
+	if analyticsClient != nil {
+		analyticsClient.RecordJobStatusTransition(ctx, analytics.JobStatusTransition{
+			Timestamp:   time.Now(),
+			JobID:       uint64(job.ID),
+			UserID:      uint64(job.File.UserID),
+			FromStatus:  string(fromStatus),
+			ToStatus:    string(toStatus),
+			TriggeredBy: triggeredBy,
+			Message:     message,
+		})
+	}
+}
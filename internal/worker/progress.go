@@ -0,0 +1,171 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mukund/mediaconvert/internal/models"
+)
+
+// ProgressFunc receives progress updates while a pipeline runs
+type ProgressFunc func(models.JobProgress)
+
+// progressTracker turns step and tool progress into overall job progress. Steps may
+// run concurrently; updates are reported one at a time.
+type progressTracker struct {
+	mu         sync.Mutex
+	report     ProgressFunc
+	totalSteps int
+	started    time.Time
+	done       []float64 // Fraction (0-1) of each step that is done
+}
+
+func newProgressTracker(totalSteps int, report ProgressFunc) *progressTracker {
+	return &progressTracker{
+		report:     report,
+		totalSteps: totalSteps,
+		started:    time.Now(),
+		done:       make([]float64, totalSteps),
+	}
+}
+
+// startStep reports that the given (1-based) step started
+func (t *progressTracker) startStep(step int, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[step-1] = 0
+	t.publish(step, name, nil)
+}
+
+// stepProgress reports the fraction (0-1) of a running step that is done
+func (t *progressTracker) stepProgress(step int, name string, fraction float64) {
+	fraction = min(max(fraction, 0), 1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[step-1] = fraction
+	t.publish(step, name, &fraction)
+}
+
+// finishStep records that a step completed. It is reported with the next update.
+func (t *progressTracker) finishStep(step int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[step-1] = 1
+}
+
+// finish reports that all steps completed
+func (t *progressTracker) finish(lastName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.done {
+		t.done[i] = 1
+	}
+	done := 1.0
+	t.publish(t.totalSteps, lastName, &done)
+}
+
+func (t *progressTracker) publish(step int, name string, stepFraction *float64) {
+	if t.report == nil || t.totalSteps == 0 {
+		return
+	}
+
+	var done float64
+	for _, fraction := range t.done {
+		done += fraction
+	}
+	progress := models.JobProgress{
+		Step:       step,
+		TotalSteps: t.totalSteps,
+		StepName:   name,
+		UpdatedAt:  time.Now(),
+	}
+	if stepFraction != nil {
+		stepPercent := roundPercent(*stepFraction)
+		progress.StepPercent = &stepPercent
+	}
+
+	overall := done / float64(t.totalSteps)
+	progress.Percent = roundPercent(overall)
+	if overall > 0 && overall < 1 {
+		elapsed := time.Since(t.started)
+		eta := int64((elapsed.Seconds() * (1 - overall) / overall) + 0.5)
+		progress.ETASeconds = &eta
+	}
+
+	t.report(progress)
+}
+
+func roundPercent(fraction float64) float64 {
+	return float64(int(fraction*1000+0.5)) / 10
+}
+
+// ffmpegProgressWriter parses the key=value blocks ffmpeg writes with -progress and
+// reports how far into the input the encode is
+type ffmpegProgressWriter struct {
+	duration time.Duration
+	onUpdate func(fraction float64)
+
+	buf     bytes.Buffer
+	outTime time.Duration
+}
+
+func (w *ffmpegProgressWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the partial line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		w.parseLine(strings.TrimSpace(line))
+	}
+	return len(p), nil
+}
+
+func (w *ffmpegProgressWriter) parseLine(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return
+	}
+
+	switch key {
+	case "out_time_us", "out_time_ms":
+		// Despite its name, out_time_ms is in microseconds as well
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			w.outTime = time.Duration(us) * time.Microsecond
+		}
+	case "progress":
+		// End of a progress block
+		if value == "end" {
+			w.onUpdate(1)
+		} else if w.duration > 0 {
+			w.onUpdate(float64(w.outTime) / float64(w.duration))
+		}
+	}
+}
+
+// probeDuration returns the duration of a media file using ffprobe
+func probeDuration(ctx context.Context, path string) (time.Duration, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	).Output()
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mukund/mediaconvert/internal/config"
+	"github.com/mukund/mediaconvert/internal/models"
+	"gorm.io/gorm"
+)
+
+// Queue backends selectable with QUEUE_BACKEND
+const (
+	QueueBackendRedis    = "redis"
+	QueueBackendPostgres = "postgres"
+)
+
+// Queue carries jobs from the API to the workers
+type Queue interface {
+	// Enqueue makes a job available to workers. The job's file must be loaded.
+	Enqueue(job *models.Job) error
+	// EnqueueAt makes a job available to workers once at is reached. The job's file must
+	// be loaded.
+	EnqueueAt(job *models.Job, at time.Time) error
+
+	// Dequeue leases the next job the consumer may take under the given filter. Jobs whose
+	// lease ran out without being acknowledged are handed out again. It returns nil if no
+	// job is available.
+	Dequeue(ctx context.Context, consumer string, filter JobFilter, lease time.Duration) (*JobMessage, error)
+	// Extend renews the consumer's lease on a dequeued job
+	Extend(ctx context.Context, consumer string, msg JobMessage, lease time.Duration) error
+	// Ack removes a dequeued job from the queue
+	Ack(ctx context.Context, msg JobMessage) error
+	// Nack returns a dequeued job to the queue, to be handed out again after delay
+	Nack(ctx context.Context, msg JobMessage, delay time.Duration) error
+	// Wait blocks until new jobs may be available
+	Wait(ctx context.Context)
+	// Maintain makes delayed jobs that are due available and tidies up the queue.
+	// Workers run it every second.
+	Maintain(ctx context.Context) error
+	// QueuedJobIDs returns the IDs of the jobs on the queue, including delayed and leased
+	// ones
+	QueuedJobIDs(ctx context.Context) (map[uint]bool, error)
+
+	Close() error
+}
+
+// Canceller carries cancel signals to the workers running jobs
+type Canceller interface {
+	// PublishJobCancel tells the worker running a job to stop it
+	PublishJobCancel(jobID uint) error
+	// JobCancellations delivers the jobs to stop until ctx is cancelled
+	JobCancellations(ctx context.Context) (<-chan uint, error)
+}
+
+// WorkerRegistry keeps the registrations of the live workers
+type WorkerRegistry interface {
+	// RegisterWorker stores a worker's registration for ttl
+	RegisterWorker(ctx context.Context, info WorkerInfo, ttl time.Duration) error
+	// UnregisterWorker removes a worker's registration
+	UnregisterWorker(ctx context.Context, id string) error
+	// ListWorkers returns the live workers, most recently seen first
+	ListWorkers(ctx context.Context) ([]WorkerInfo, error)
+}
+
+// Backend coordinates the API and the workers: it queues jobs, carries cancel signals and
+// keeps the worker registry. The Redis and PostgreSQL backends provide all three, so that
+// a deployment only needs one of them.
+type Backend struct {
+	Queue     Queue
+	Canceller Canceller
+	Workers   WorkerRegistry
+}
+
+// Close disconnects from the backend
+func (b *Backend) Close() error {
+	return b.Queue.Close()
+}
+
+// OpenBackend connects to the backend selected in the config
+func OpenBackend(cfg *config.Config, db *gorm.DB) (*Backend, error) {
+	switch cfg.QueueBackend {
+	case QueueBackendRedis, "":
+		queue, err := NewRedisQueue(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		return &Backend{Queue: queue, Canceller: queue, Workers: queue}, nil
+	case QueueBackendPostgres:
+		queue, err := NewPostgresQueue(db, cfg.DatabaseURL)
+		if err != nil {
+			return nil, err
+		}
+		return &Backend{Queue: queue, Canceller: queue, Workers: queue}, nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q, use %q or %q", cfg.QueueBackend, QueueBackendRedis, QueueBackendPostgres)
+	}
+}
+
+// JobMessage is a job handed to a worker by the queue
+type JobMessage struct {
+	Stream string // Stream the entry was read from (Redis)
+	ID     string // Entry ID, used for acknowledgement
+	JobID  uint
+}
+
+// JobFilter selects the jobs a worker takes
+type JobFilter struct {
+	Queues       []string
+	Capabilities []string      // Capabilities of the worker
+	SkipUsers    map[uint]bool // Users whose jobs are left alone, e.g. because they are at their concurrency limit
+}
+
+var queueNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,50}$`)
+
+// ValidateJobRouting checks the queue name and priority a job is submitted with
+func ValidateJobRouting(queue string, priority int) error {
+	if !queueNamePattern.MatchString(queue) {
+		return fmt.Errorf("invalid queue name %q: use 1-50 lowercase letters, digits, '-' or '_'", queue)
+	}
+	if priority < models.MinJobPriority || priority > models.MaxJobPriority {
+		return fmt.Errorf("priority must be between %d and %d", models.MinJobPriority, models.MaxJobPriority)
+	}
+	return nil
+}
+
+// parseJobCancel parses the job ID carried by a cancel signal
+func parseJobCancel(payload string) (uint, bool) {
+	jobID, err := strconv.ParseUint(payload, 10, 32)
+	if err != nil {
+		fmt.Printf("Invalid job ID in cancel signal: %s\n", payload)
+		return 0, false
+	}
+	return uint(jobID), true
+}
@@ -0,0 +1,165 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mukund/mediaconvert/internal/analytics"
+	"github.com/mukund/mediaconvert/internal/config"
+	"github.com/mukund/mediaconvert/internal/models"
+	"gorm.io/gorm"
+)
+
+// Reaper returns jobs that were abandoned by crashed workers, or never made it
+// onto the job queue, back to the queue
+type Reaper struct {
+	db        *gorm.DB
+	queue     Queue
+	canceller Canceller
+	analytics *analytics.Client
+	config    *config.Config
+}
+
+// NewReaper creates a new reaper
+func NewReaper(db *gorm.DB, queue Queue, canceller Canceller, analyticsClient *analytics.Client, cfg *config.Config) *Reaper {
+	return &Reaper{
+		db:        db,
+		queue:     queue,
+		canceller: canceller,
+		analytics: analyticsClient,
+		config:    cfg,
+	}
+}
+
+// Run periodically re-queues processing jobs whose lease has expired, ends jobs past their
+// expires_at time and purges expired idempotency keys, until ctx is cancelled
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.ReaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.ReapExpiredLeases(ctx); err != nil {
+				log.Printf("Failed to reap expired leases: %v", err)
+			}
+			if err := r.ExpireJobs(ctx); err != nil {
+				log.Printf("Failed to expire jobs: %v", err)
+			}
+			if _, err := PurgeExpiredIdempotencyKeys(r.db); err != nil {
+				log.Printf("Failed to purge expired idempotency keys: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReapExpiredLeases moves processing jobs whose worker stopped renewing the lease back to
+// pending. Jobs that already used up the attempts their retry policy allows are likely
+// crashing workers, so they are dead-lettered instead.
+func (r *Reaper) ReapExpiredLeases(ctx context.Context) error {
+	var jobs []models.Job
+	if err := r.db.Preload("File").Preload("Pipeline").Preload("PipelineVersion").
+		Where("status = ? AND lease_expires_at < ?", models.JobStatusProcessing, time.Now()).
+		Find(&jobs).Error; err != nil {
+		return fmt.Errorf("failed to find expired leases: %w", err)
+	}
+
+	for _, job := range jobs {
+		if job.Attempts >= JobRetryPolicy(r.config, &job).MaxAttempts {
+			r.deadLetter(ctx, &job)
+			continue
+		}
+
+		// Conditional update so that only one reaper re-queues the job, and a lease
+		// renewed in the meantime is respected
+		result := r.db.Model(&models.Job{}).
+			Where("id = ? AND status = ? AND lease_expires_at < ?", job.ID, models.JobStatusProcessing, time.Now()).
+			Updates(map[string]interface{}{
+				"status":           models.JobStatusPending,
+				"lease_owner":      "",
+				"lease_expires_at": nil,
+			})
+		if result.Error != nil {
+			log.Printf("Failed to re-queue job %d: %v", job.ID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		message := fmt.Sprintf("Lease held by worker %s expired, re-queued", job.LeaseOwner)
+		recordTransition(ctx, r.db, r.analytics, &job, models.JobStatusProcessing, models.JobStatusPending, message, "system")
+
+		if err := r.queue.Enqueue(&job); err != nil {
+			log.Printf("Failed to enqueue job %d: %v", job.ID, err)
+		}
+		log.Printf("Re-queued job %d after its lease expired", job.ID)
+	}
+
+	return nil
+}
+
+// deadLetter moves a job whose lease expired on its last attempt to the dead-letter list
+func (r *Reaper) deadLetter(ctx context.Context, job *models.Job) {
+	now := time.Now()
+	message := fmt.Sprintf("Lease held by worker %s expired on attempt %d, the job may be crashing workers", job.LeaseOwner, job.Attempts)
+	result := r.db.Model(&models.Job{}).
+		Where("id = ? AND status = ? AND lease_expires_at < ?", job.ID, models.JobStatusProcessing, now).
+		Updates(map[string]interface{}{
+			"status":           models.JobStatusDeadLettered,
+			"error":            message,
+			"dead_lettered_at": now,
+			"lease_owner":      "",
+			"lease_expires_at": nil,
+		})
+	if result.Error != nil {
+		log.Printf("Failed to dead-letter job %d: %v", job.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	recordTransition(ctx, r.db, r.analytics, job, models.JobStatusProcessing, models.JobStatusDeadLettered, message, "system")
+	log.Printf("Dead-lettered job %d after its lease expired %d times", job.ID, job.Attempts)
+}
+
+// RecoverPending re-queues pending jobs older than the sweep age that are missing from the
+// queue, e.g. because they were created while the queue was unavailable. Jobs still on the
+// queue are left alone. The jobs stay pending, so no status change is recorded.
+func (r *Reaper) RecoverPending(ctx context.Context) error {
+	// Look at the queue first: jobs enqueued in the meantime are newer than the sweep age
+	queued, err := r.queue.QueuedJobIDs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list queued jobs: %w", err)
+	}
+
+	var jobs []models.Job
+	if err := r.db.Preload("File").
+		Where("status = ? AND created_at < ?", models.JobStatusPending, time.Now().Add(-r.config.PendingSweepAge)).
+		Find(&jobs).Error; err != nil {
+		return fmt.Errorf("failed to find pending jobs: %w", err)
+	}
+
+	recovered := 0
+	for _, job := range jobs {
+		if queued[job.ID] {
+			continue
+		}
+		if err := r.queue.Enqueue(&job); err != nil {
+			log.Printf("Failed to enqueue job %d: %v", job.ID, err)
+			continue
+		}
+		log.Printf("Re-queued pending job %d, which was missing from the queue", job.ID)
+		recovered++
+	}
+
+	if recovered > 0 {
+		log.Printf("Re-queued %d pending jobs missing from the queue", recovered)
+	}
+	return nil
+}
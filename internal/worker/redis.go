@@ -2,20 +2,122 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/mukund/mediaconvert/internal/models"
 	"github.com/redis/go-redis/v9"
 )
 
-const JobNotificationChannel = "job:notifications"
+const (
+	// JobStreamPrefix prefixes the Redis streams jobs are enqueued on, one per queue, priority and user
+	JobStreamPrefix = "jobs:stream"
+	// JobConsumerGroup is the consumer group shared by all workers
+	JobConsumerGroup = "job-workers"
+	// JobCancelChannel is the pub/sub channel used to stop running jobs
+	JobCancelChannel = "job:cancel"
+	// JobDelayedKey is the sorted set of jobs waiting to be enqueued, scored by due time (unix ms)
+	JobDelayedKey = "jobs:delayed"
+	// JobStreamsKey is the set of job streams that have a consumer group
+	JobStreamsKey = "jobs:streams"
+	// JobDispatchCursorKey holds the user whose job was dispatched last, so that the next
+	// dispatch starts with the user after them
+	JobDispatchCursorKey = "jobs:dispatch:last-user"
+	// WorkersKey is the sorted set of registered worker IDs, scored by last heartbeat (unix ms)
+	WorkersKey = "workers"
+	// WorkerKeyPrefix prefixes the key holding a worker's registration, which expires
+	// when the worker stops sending heartbeats
+	WorkerKeyPrefix = "workers:info:"
+)
+
+// enqueueJobScript appends a job to a stream, creating the stream's consumer group and
+// registering the stream in the set of job streams in the same step
+var enqueueJobScript = redis.NewScript(`
+redis.pcall('XGROUP', 'CREATE', KEYS[1], ARGV[1], '0', 'MKSTREAM')
+redis.call('SADD', KEYS[2], KEYS[1])
+return redis.call('XADD', KEYS[1], '*', 'job_id', ARGV[2])
+`)
+
+// promoteDueJobsScript atomically moves due jobs from the delayed set onto their job stream,
+// so that several workers running the scheduler never enqueue the same job twice.
+// Members of the delayed set have the form "<job id>@<stream>". The streams are only known
+// inside the script, so they aren't declared in KEYS (see RedisQueue).
+var promoteDueJobsScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(due) do
+	redis.call('ZREM', KEYS[1], member)
+	local id, stream = string.match(member, '^(%d+)@(.+)$')
+	if id then
+		redis.pcall('XGROUP', 'CREATE', stream, ARGV[3], '0', 'MKSTREAM')
+		redis.call('SADD', KEYS[2], stream)
+		redis.call('XADD', stream, '*', 'job_id', id)
+	end
+end
+return #due
+`)
+
+// nextJobScript claims a single job for a consumer, walking the streams in the given
+// (priority and user) order. Within a stream, entries abandoned by other consumers for
+// longer than the idle time are taken over before new entries are read.
+var nextJobScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if redis.call('XLEN', key) > 0 then
+		local claimed = redis.call('XAUTOCLAIM', key, ARGV[1], ARGV[2], ARGV[3], '0-0', 'COUNT', 1)
+		local entry = claimed[2][1]
+		if entry and entry[2] then
+			return {key, entry[1], entry[2]}
+		end
+		local read = redis.call('XREADGROUP', 'GROUP', ARGV[1], ARGV[2], 'COUNT', 1, 'STREAMS', key, '>')
+		if read then
+			entry = read[1][2][1]
+			return {key, entry[1], entry[2]}
+		end
+	end
+end
+return false
+`)
+
+// pruneStreamsScript forgets job streams that have no entries left. The streams keep their
+// consumer group, and are registered again by the next enqueue. Like promoteDueJobsScript,
+// it accesses streams that aren't declared in KEYS.
+var pruneStreamsScript = redis.NewScript(`
+local pruned = 0
+for _, key in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	if redis.call('XLEN', key) == 0 then
+		redis.call('SREM', KEYS[1], key)
+		pruned = pruned + 1
+	end
+end
+return pruned
+`)
+
+const (
+	// redisPollInterval is how long an idle worker waits before looking for jobs again
+	redisPollInterval = 500 * time.Millisecond
+	// redisPruneInterval is how often empty job streams are pruned
+	redisPruneInterval = time.Minute
+)
 
-// RedisClient wraps redis client for job notifications
-type RedisClient struct {
+// RedisQueue is a Queue on Redis streams. Each queue, priority, user and set of required
+// capabilities has its own stream, read by a consumer group shared by all workers.
+// It needs a single Redis server (with replicas, if any), not Redis Cluster: the streams
+// are created at run time, and some scripts access streams they find in the delayed set or
+// the set of streams without declaring them in KEYS.
+type RedisQueue struct {
 	client *redis.Client
+
+	mu         sync.Mutex
+	lastPruned time.Time
 }
 
-// NewRedisClient creates a new Redis client
-func NewRedisClient(addr string) (*RedisClient, error) {
+// NewRedisQueue connects to the Redis server at addr
+func NewRedisQueue(addr string) (*RedisQueue, error) {
 	opt, err := redis.ParseURL(addr)
 	if err != nil {
 		// Try direct connection if URL parsing fails
@@ -32,21 +134,370 @@ func NewRedisClient(addr string) (*RedisClient, error) {
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return &RedisClient{client: client}, nil
+	return &RedisQueue{client: client}, nil
+}
+
+// JobStreamKey returns the stream for the given user's jobs of the given queue and priority
+// that need the given capabilities (as stored on the job). Each user's jobs are kept on
+// their own streams so that workers can take turns between users, and jobs needing
+// different capabilities are kept apart so that workers only read the jobs they are able
+// to run.
+func JobStreamKey(queue string, priority int, userID uint, capabilities string) string {
+	if queue == "" {
+		queue = models.DefaultJobQueue
+	}
+	key := fmt.Sprintf("%s:%s:%d:%d", JobStreamPrefix, queue, priority, userID)
+	if capabilities != "" {
+		key += ":" + capabilities
+	}
+	return key
+}
+
+// jobStream returns the stream a job is enqueued on. The job's file must be loaded.
+func jobStream(job *models.Job) string {
+	return JobStreamKey(job.Queue, job.Priority, job.File.UserID, job.Capabilities)
+}
+
+// streamUser returns the user whose jobs a stream holds
+func streamUser(stream string) (uint, bool) {
+	parts := strings.SplitN(stream, ":", 6)
+	if len(parts) < 5 {
+		return 0, false
+	}
+	userID, err := strconv.ParseUint(parts[4], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(userID), true
+}
+
+// routableStreams selects the streams a worker can take jobs from, highest priority first.
+// Within a priority, users take turns: the streams of the users after lastUser come first,
+// followed by the streams of the users up to and including lastUser.
+func routableStreams(streams []string, filter JobFilter, lastUser uint) []string {
+	sort.Strings(streams)
+
+	var keys []string
+	for priority := models.MaxJobPriority; priority >= models.MinJobPriority; priority-- {
+		byUser := make(map[uint][]string)
+		var users []uint
+		for _, queue := range filter.Queues {
+			base := fmt.Sprintf("%s:%s:%d:", JobStreamPrefix, queue, priority)
+			for _, stream := range streams {
+				rest, ok := strings.CutPrefix(stream, base)
+				if !ok {
+					continue
+				}
+				user, required, _ := strings.Cut(rest, ":")
+				userID, err := strconv.ParseUint(user, 10, 32)
+				if err != nil || filter.SkipUsers[uint(userID)] {
+					continue
+				}
+				if required != "" && !hasCapabilities(filter.Capabilities, required) {
+					continue
+				}
+				if _, ok := byUser[uint(userID)]; !ok {
+					users = append(users, uint(userID))
+				}
+				byUser[uint(userID)] = append(byUser[uint(userID)], stream)
+			}
+		}
+
+		sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+		next := sort.Search(len(users), func(i int) bool { return users[i] > lastUser })
+		for _, userID := range append(users[next:], users[:next]...) {
+			keys = append(keys, byUser[userID]...)
+		}
+	}
+	return keys
+}
+
+// Enqueue appends a job to the stream for its queue, priority, user and capabilities
+func (r *RedisQueue) Enqueue(job *models.Job) error {
+	return enqueueJobScript.Run(context.Background(), r.client,
+		[]string{jobStream(job), JobStreamsKey},
+		JobConsumerGroup, job.ID,
+	).Err()
+}
+
+// EnqueueAt schedules a job to be appended to its stream once at is reached
+func (r *RedisQueue) EnqueueAt(job *models.Job, at time.Time) error {
+	return r.delay(context.Background(), job.ID, jobStream(job), at)
+}
+
+func (r *RedisQueue) delay(ctx context.Context, jobID uint, stream string, at time.Time) error {
+	return r.client.ZAdd(ctx, JobDelayedKey, redis.Z{
+		Score:  float64(at.UnixMilli()),
+		Member: fmt.Sprintf("%d@%s", jobID, stream),
+	}).Err()
+}
+
+// Maintain moves delayed jobs that are due onto their streams, and now and then forgets
+// the job streams that are empty so that workers don't keep checking the streams of users
+// who no longer submit jobs
+func (r *RedisQueue) Maintain(ctx context.Context) error {
+	for {
+		n, err := promoteDueJobsScript.Run(ctx, r.client,
+			[]string{JobDelayedKey, JobStreamsKey},
+			time.Now().UnixMilli(), 100, JobConsumerGroup,
+		).Int()
+		if err != nil {
+			return fmt.Errorf("failed to promote delayed jobs: %w", err)
+		}
+		if n < 100 {
+			break
+		}
+	}
+
+	r.mu.Lock()
+	prune := time.Since(r.lastPruned) >= redisPruneInterval
+	if prune {
+		r.lastPruned = time.Now()
+	}
+	r.mu.Unlock()
+	if prune {
+		if err := pruneStreamsScript.Run(ctx, r.client, []string{JobStreamsKey}).Err(); err != nil {
+			return fmt.Errorf("failed to prune job streams: %w", err)
+		}
+	}
+	return nil
+}
+
+// QueuedJobIDs returns the IDs of the jobs on the job streams, acknowledged entries being
+// deleted, and in the delayed set
+func (r *RedisQueue) QueuedJobIDs(ctx context.Context) (map[uint]bool, error) {
+	ids := make(map[uint]bool)
+
+	streams, err := r.client.SMembers(ctx, JobStreamsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, stream := range streams {
+		start := "-"
+		for {
+			entries, err := r.client.XRangeN(ctx, stream, start, "+", 1000).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", stream, err)
+			}
+			for _, entry := range entries {
+				raw, _ := entry.Values["job_id"].(string)
+				if jobID, err := strconv.ParseUint(raw, 10, 32); err == nil {
+					ids[uint(jobID)] = true
+				}
+			}
+			if len(entries) < 1000 {
+				break
+			}
+			start = "(" + entries[len(entries)-1].ID
+		}
+	}
+
+	delayed, err := r.client.ZRange(ctx, JobDelayedKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range delayed {
+		raw, _, _ := strings.Cut(member, "@")
+		if jobID, err := strconv.ParseUint(raw, 10, 32); err == nil {
+			ids[uint(jobID)] = true
+		}
+	}
+	return ids, nil
 }
 
-// PublishJobNotification publishes a job notification to Redis
-func (r *RedisClient) PublishJobNotification(jobID uint) error {
+// Dequeue claims the highest-priority job that a consumer may take under the given filter,
+// taking turns between users with jobs of the same priority. Jobs other consumers left
+// unacknowledged for longer than lease are taken over first. It returns nil if no job is
+// available.
+func (r *RedisQueue) Dequeue(ctx context.Context, consumer string, filter JobFilter, lease time.Duration) (*JobMessage, error) {
+	pipe := r.client.Pipeline()
+	membersCmd := pipe.SMembers(ctx, JobStreamsKey)
+	cursorCmd := pipe.Get(ctx, JobDispatchCursorKey)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	lastUser, _ := cursorCmd.Uint64()
+
+	keys := routableStreams(membersCmd.Val(), filter, uint(lastUser))
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	res, err := nextJobScript.Run(ctx, r.client, keys,
+		JobConsumerGroup, consumer, lease.Milliseconds(),
+	).Slice()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stream, _ := res[0].(string)
+	id, _ := res[1].(string)
+	fields, _ := res[2].([]interface{})
+
+	if userID, ok := streamUser(stream); ok {
+		r.client.Set(ctx, JobDispatchCursorKey, userID, 0)
+	}
+
+	var raw string
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] == "job_id" {
+			raw, _ = fields[i+1].(string)
+		}
+	}
+
+	jobID, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil {
+		fmt.Printf("Dropping invalid job message %s on %s: %v\n", id, stream, fields)
+		r.Ack(ctx, JobMessage{Stream: stream, ID: id})
+		return nil, nil
+	}
+
+	return &JobMessage{Stream: stream, ID: id, JobID: uint(jobID)}, nil
+}
+
+// Extend resets the idle time of a job so it isn't taken over while still being processed
+func (r *RedisQueue) Extend(ctx context.Context, consumer string, msg JobMessage, lease time.Duration) error {
+	return r.client.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream:   msg.Stream,
+		Group:    JobConsumerGroup,
+		Consumer: consumer,
+		MinIdle:  0,
+		Messages: []string{msg.ID},
+	}).Err()
+}
+
+// Ack acknowledges a job and removes it from its stream
+func (r *RedisQueue) Ack(ctx context.Context, msg JobMessage) error {
+	if err := r.client.XAck(ctx, msg.Stream, JobConsumerGroup, msg.ID).Err(); err != nil {
+		return err
+	}
+	return r.client.XDel(ctx, msg.Stream, msg.ID).Err()
+}
+
+// Nack removes a job from its stream and appends it again once delay has passed
+func (r *RedisQueue) Nack(ctx context.Context, msg JobMessage, delay time.Duration) error {
+	if err := r.delay(ctx, msg.JobID, msg.Stream, time.Now().Add(delay)); err != nil {
+		return err
+	}
+	return r.Ack(ctx, msg)
+}
+
+// Wait sleeps for the poll interval, as Redis streams are polled for new jobs
+func (r *RedisQueue) Wait(ctx context.Context) {
+	select {
+	case <-time.After(redisPollInterval):
+	case <-ctx.Done():
+	}
+}
+
+// PublishJobCancel tells the worker running a job to stop it
+func (r *RedisQueue) PublishJobCancel(jobID uint) error {
 	ctx := context.Background()
-	return r.client.Publish(ctx, JobNotificationChannel, fmt.Sprintf("%d", jobID)).Err()
+	return r.client.Publish(ctx, JobCancelChannel, fmt.Sprintf("%d", jobID)).Err()
 }
 
-// SubscribeToJobNotifications subscribes to job notifications
-func (r *RedisClient) SubscribeToJobNotifications(ctx context.Context) *redis.PubSub {
-	return r.client.Subscribe(ctx, JobNotificationChannel)
+// JobCancellations delivers the jobs to stop until ctx is cancelled
+func (r *RedisQueue) JobCancellations(ctx context.Context) (<-chan uint, error) {
+	pubsub := r.client.Subscribe(ctx, JobCancelChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	jobIDs := make(chan uint)
+	go func() {
+		defer pubsub.Close()
+		defer close(jobIDs)
+
+		ch := pubsub.Channel()
+		for {
+			select {
+			case msg := <-ch:
+				if jobID, ok := parseJobCancel(msg.Payload); ok {
+					select {
+					case jobIDs <- jobID:
+					case <-ctx.Done():
+						return
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return jobIDs, nil
+}
+
+// RegisterWorker stores a worker's registration for ttl
+func (r *RedisQueue) RegisterWorker(ctx context.Context, info WorkerInfo, ttl time.Duration) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, WorkerKeyPrefix+info.ID, data, ttl)
+	pipe.ZAdd(ctx, WorkersKey, redis.Z{Score: float64(info.LastSeen.UnixMilli()), Member: info.ID})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// UnregisterWorker removes a worker's registration
+func (r *RedisQueue) UnregisterWorker(ctx context.Context, id string) error {
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, WorkerKeyPrefix+id)
+	pipe.ZRem(ctx, WorkersKey, id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ListWorkers returns the live workers, most recently seen first. Workers whose
+// registration expired are dropped from the registry.
+func (r *RedisQueue) ListWorkers(ctx context.Context) ([]WorkerInfo, error) {
+	ids, err := r.client.ZRevRange(ctx, WorkersKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []WorkerInfo{}, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = WorkerKeyPrefix + id
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	workers := []WorkerInfo{}
+	var expired []interface{}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			expired = append(expired, ids[i])
+			continue
+		}
+
+		var info WorkerInfo
+		if err := json.Unmarshal([]byte(data), &info); err != nil {
+			return nil, fmt.Errorf("invalid registration of worker %s: %w", ids[i], err)
+		}
+		workers = append(workers, info)
+	}
+
+	if len(expired) > 0 {
+		r.client.ZRem(ctx, WorkersKey, expired...)
+	}
+
+	return workers, nil
 }
 
 // Close closes the Redis connection
-func (r *RedisClient) Close() error {
+func (r *RedisQueue) Close() error {
 	return r.client.Close()
 }
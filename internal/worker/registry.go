@@ -0,0 +1,78 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// WorkerInfo describes a running worker, as published in its heartbeats
+type WorkerInfo struct {
+	ID           string            `json:"id"`
+	Hostname     string            `json:"hostname"`
+	Version      string            `json:"version"`
+	Concurrency  int               `json:"concurrency"`
+	Queues       []string          `json:"queues"`
+	Capabilities []string          `json:"capabilities"`
+	Tools        map[string]string `json:"tools"` // Tool name to version
+	StartedAt    time.Time         `json:"started_at"`
+	LastSeen     time.Time         `json:"last_seen"`
+	Jobs         []uint            `json:"jobs"` // Jobs the worker is running
+}
+
+// Registry keeps a worker's registration alive on the queue while it runs
+type Registry struct {
+	workers   WorkerRegistry
+	processor *JobProcessor
+	info      WorkerInfo
+	interval  time.Duration
+}
+
+// NewRegistry creates a registry for the worker described by info
+func NewRegistry(workers WorkerRegistry, processor *JobProcessor, info WorkerInfo, interval time.Duration) *Registry {
+	if info.Hostname == "" {
+		info.Hostname, _ = os.Hostname()
+	}
+	if info.StartedAt.IsZero() {
+		info.StartedAt = time.Now()
+	}
+	return &Registry{
+		workers:   workers,
+		processor: processor,
+		info:      info,
+		interval:  interval,
+	}
+}
+
+// Run sends a heartbeat every interval until ctx is cancelled
+func (r *Registry) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.heartbeat(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to send worker heartbeat: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Unregister removes the worker from the registry
+func (r *Registry) Unregister(ctx context.Context) error {
+	return r.workers.UnregisterWorker(ctx, r.info.ID)
+}
+
+func (r *Registry) heartbeat(ctx context.Context) error {
+	info := r.info
+	info.LastSeen = time.Now()
+	info.Jobs = r.processor.RunningJobs()
+
+	// Registrations outlive a few missed heartbeats before the worker is considered gone
+	return r.workers.RegisterWorker(ctx, info, 3*r.interval)
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/mukund/mediaconvert/internal/config"
+	"github.com/mukund/mediaconvert/internal/models"
+	"github.com/mukund/mediaconvert/internal/pipeline"
+)
+
+// RetryPolicy controls how often and how quickly failed jobs are retried
+type RetryPolicy struct {
+	MaxAttempts int           // Total attempts including the first one
+	Backoff     time.Duration // Delay before the first retry, doubled on each further attempt
+	MaxBackoff  time.Duration // Upper bound for the delay
+	Jitter      float64       // Random spread applied to the delay, as a fraction (0.2 = ±20%)
+}
+
+// DefaultRetryPolicy builds the global retry policy from config
+func DefaultRetryPolicy(cfg *config.Config) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: cfg.RetryMaxAttempts,
+		Backoff:     cfg.RetryBackoff,
+		MaxBackoff:  cfg.RetryMaxBackoff,
+		Jitter:      cfg.RetryJitter,
+	}
+}
+
+// WithOverrides applies the settings a pipeline declares on top of the policy
+func (r RetryPolicy) WithOverrides(p *pipeline.RetryPolicy) RetryPolicy {
+	if p == nil {
+		return r
+	}
+	if p.MaxAttempts > 0 {
+		r.MaxAttempts = p.MaxAttempts
+	}
+	if d, err := time.ParseDuration(p.Backoff); err == nil && p.Backoff != "" {
+		r.Backoff = d
+	}
+	if d, err := time.ParseDuration(p.MaxBackoff); err == nil && p.MaxBackoff != "" {
+		r.MaxBackoff = d
+	}
+	if p.Jitter != nil {
+		r.Jitter = *p.Jitter
+	}
+	return r
+}
+
+// JobRetryPolicy returns the retry policy a job runs under: the global policy with the
+// overrides of the pipeline it runs, as ProcessJob applies them. The job's Pipeline and
+// PipelineVersion must be loaded.
+func JobRetryPolicy(cfg *config.Config, job *models.Job) RetryPolicy {
+	policy := DefaultRetryPolicy(cfg)
+	if p, err := jobPipeline(job); err == nil {
+		policy = policy.WithOverrides(p.Retry)
+	}
+	return policy
+}
+
+// Delay returns how long to wait before the given retry (1 for the first retry)
+func (r RetryPolicy) Delay(retry int) time.Duration {
+	delay := r.Backoff
+	for i := 1; i < retry && i < 20; i++ {
+		delay *= 2
+		if r.MaxBackoff > 0 && delay >= r.MaxBackoff {
+			break
+		}
+	}
+	if r.MaxBackoff > 0 && delay > r.MaxBackoff {
+		delay = r.MaxBackoff
+	}
+	if r.Jitter > 0 {
+		spread := float64(delay) * r.Jitter
+		delay += time.Duration(spread * (2*rand.Float64() - 1))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// retryableError marks a failure as transient (I/O, storage), so the job may succeed if run again
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// retryable marks err as transient. Errors that aren't marked are terminal.
+func retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// IsRetryable reports whether err was classified as transient
+func IsRetryable(err error) bool {
+	var r *retryableError
+	return errors.As(err, &r)
+}
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mukund/mediaconvert/internal/analytics"
+	"github.com/mukund/mediaconvert/internal/models"
+	"gorm.io/gorm"
+)
+
+// Scheduler moves jobs onto the job queue once they are due: scheduled jobs when
+// their run_at time is reached, and retries when their backoff has elapsed
+type Scheduler struct {
+	db        *gorm.DB
+	queue     Queue
+	analytics *analytics.Client
+}
+
+// NewScheduler creates a new scheduler
+func NewScheduler(db *gorm.DB, queue Queue, analyticsClient *analytics.Client) *Scheduler {
+	return &Scheduler{
+		db:        db,
+		queue:     queue,
+		analytics: analyticsClient,
+	}
+}
+
+// Run promotes due jobs every interval until ctx is cancelled
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.PromoteScheduledJobs(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to promote scheduled jobs: %v", err)
+			}
+			if err := s.queue.Maintain(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to maintain job queue: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// PromoteScheduledJobs moves scheduled jobs whose run_at time has passed to pending and enqueues them
+func (s *Scheduler) PromoteScheduledJobs(ctx context.Context) error {
+	var jobs []models.Job
+	if err := s.db.Preload("File").
+		Where("status = ? AND run_at <= ?", models.JobStatusScheduled, time.Now()).
+		Order("run_at").
+		Limit(100).
+		Find(&jobs).Error; err != nil {
+		return fmt.Errorf("failed to find due jobs: %w", err)
+	}
+
+	for _, job := range jobs {
+		// Conditional update so that only one scheduler promotes the job, and a job
+		// cancelled in the meantime stays cancelled
+		result := s.db.Model(&models.Job{}).
+			Where("id = ? AND status = ?", job.ID, models.JobStatusScheduled).
+			Update("status", models.JobStatusPending)
+		if result.Error != nil {
+			log.Printf("Failed to promote job %d: %v", job.ID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		recordTransition(ctx, s.db, s.analytics, &job, models.JobStatusScheduled, models.JobStatusPending, "Scheduled run time reached", "system")
+
+		if err := s.queue.Enqueue(&job); err != nil {
+			log.Printf("Failed to enqueue job %d: %v", job.ID, err)
+		}
+	}
+
+	return nil
+}